@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+// Address is a postal address of a User.
+//
+// For compatibility with older clients, it can also be unmarshaled from a
+// free-form JSON string, which is then parsed on a best-effort basis (see
+// ParseAddress).
+type Address struct {
+	// Lines are the street address lines, e.g. street name & number,
+	// apartment number.
+	Lines      []string `json:"lines"`
+	City       string   `json:"city"`
+	PostalCode string   `json:"postal_code,omitempty"`
+	// Country is an ISO 3166-1 alpha-2 code, e.g. "PL".
+	Country string `json:"country"`
+
+	// freeForm is true if the Address was parsed from a free-form string
+	// (see ParseAddress).
+	freeForm bool
+}
+
+// defaultAddressCountry is the country assumed for free-form addresses which
+// don't mention it. See SetDefaultAddressCountry.
+var defaultAddressCountry = "PL"
+
+// SetDefaultAddressCountry sets the country (ISO 3166-1 alpha-2 code, e.g.
+// "PL") assumed for free-form addresses which don't mention any. It must be
+// called before any User is validated or database migrated.
+func SetDefaultAddressCountry(country string) error {
+	country = strings.ToUpper(country)
+	if !validCountry(country) {
+		return fmt.Errorf("unknown country code %q", country)
+	}
+	defaultAddressCountry = country
+	return nil
+}
+
+// validCountry returns true if code is an uppercase ISO 3166-1 alpha-2 code.
+// Regions known to the phone numbers library are used as the list of codes,
+// as they cover all countries with a postal service.
+func validCountry(code string) bool {
+	return len(code) == 2 && phonenumbers.GetSupportedRegions()[code]
+}
+
+// postalCodeFormats are patterns of valid postal codes (after normalization)
+// in countries where we can validate them. In other countries, postal codes
+// are only checked for length.
+var postalCodeFormats = map[string]*regexp.Regexp{
+	"CA": regexp.MustCompile(`^[A-Z]\d[A-Z] \d[A-Z]\d$`),
+	"DE": regexp.MustCompile(`^\d{5}$`),
+	"ES": regexp.MustCompile(`^\d{5}$`),
+	"FR": regexp.MustCompile(`^\d{5}$`),
+	"GB": regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? \d[A-Z]{2}$`),
+	"IT": regexp.MustCompile(`^\d{5}$`),
+	"NL": regexp.MustCompile(`^\d{4} [A-Z]{2}$`),
+	"PL": regexp.MustCompile(`^\d{2}-\d{3}$`),
+	"US": regexp.MustCompile(`^\d{5}(-\d{4})?$`),
+}
+
+// NormalizePostalCode uppercases a postal code and normalizes whitespace in
+// it. In countries where postal codes have a space at a fixed position (like
+// "SW1A 1AA" in GB), it is inserted if missing.
+func NormalizePostalCode(code, country string) string {
+	code = strings.ToUpper(strings.Join(strings.Fields(code), ""))
+	switch country {
+	case "GB", "CA":
+		if len(code) > 3 {
+			code = code[:len(code)-3] + " " + code[len(code)-3:]
+		}
+	case "NL":
+		if len(code) > 2 {
+			code = code[:len(code)-2] + " " + code[len(code)-2:]
+		}
+	}
+	return code
+}
+
+// Validate checks if the Address is complete and valid in its country. If
+// not, an error is returned with a detailed message, where field names are
+// prefixed with ".address". Surrounding whitespace is removed from all
+// fields, and .Country and .PostalCode are normalized. The city is optional
+// in addresses parsed from free-form strings, as it can't always be told
+// apart from the street address, and such addresses were valid in v1.
+func (a *Address) Validate() error {
+	for i := range a.Lines {
+		a.Lines[i] = strings.TrimSpace(a.Lines[i])
+	}
+	a.City = strings.TrimSpace(a.City)
+	a.Country = strings.ToUpper(strings.TrimSpace(a.Country))
+	a.PostalCode = NormalizePostalCode(a.PostalCode, a.Country)
+
+	switch {
+	case len(a.Lines) == 0:
+		return errors.New(".address.lines must have at least one line")
+	case len(a.Lines) > 3:
+		return errors.New(".address.lines must have at most 3 lines")
+	}
+	for i, line := range a.Lines {
+		switch {
+		case line == "":
+			return fmt.Errorf(".address.lines[%d] must not be empty", i)
+		case len(line) > 100:
+			return fmt.Errorf(".address.lines[%d] must be at most 100 characters long", i)
+		}
+	}
+	switch {
+	case a.City == "" && !a.freeForm:
+		return errors.New(".address.city mandatory field is missing")
+	case len(a.City) > 100:
+		return errors.New(".address.city must be at most 100 characters long")
+	case a.Country == "":
+		return errors.New(".address.country mandatory field is missing")
+	case !validCountry(a.Country):
+		return errors.New(".address.country must be an ISO 3166-1 alpha-2 country code")
+	case len(a.PostalCode) > 16:
+		return errors.New(".address.postal_code must be at most 16 characters long")
+	}
+	if format := postalCodeFormats[a.Country]; format != nil && a.PostalCode != "" && !format.MatchString(a.PostalCode) {
+		return fmt.Errorf(".address.postal_code is not a valid postal code in %s", a.Country)
+	}
+	return nil
+}
+
+func (a *Address) UnmarshalJSON(buf []byte) error {
+	var s string
+	if json.Unmarshal(buf, &s) == nil {
+		*a = ParseAddress(s)
+		return nil
+	}
+	// Note: the address type is needed to avoid infinite recursion
+	type address Address
+	a.freeForm = false
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*address)(a))
+}
+
+// countryNames maps names of countries commonly found in free-form addresses
+// to their codes. Codes themselves are recognized too.
+var countryNames = map[string]string{
+	"uk":                       "GB",
+	"united kingdom":           "GB",
+	"england":                  "GB",
+	"scotland":                 "GB",
+	"wales":                    "GB",
+	"usa":                      "US",
+	"united states":            "US",
+	"united states of america": "US",
+	"poland":                   "PL",
+	"polska":                   "PL",
+	"germany":                  "DE",
+	"deutschland":              "DE",
+	"france":                   "FR",
+	"spain":                    "ES",
+	"italy":                    "IT",
+	"netherlands":              "NL",
+	"the netherlands":          "NL",
+	"canada":                   "CA",
+}
+
+// countryCode returns the code of a country name or code, or an empty string
+// if it's not recognized.
+func countryCode(name string) string {
+	name = strings.TrimSpace(name)
+	if code, ok := countryNames[strings.ToLower(name)]; ok {
+		return code
+	}
+	if code := strings.ToUpper(name); validCountry(code) {
+		return code
+	}
+	return ""
+}
+
+// ParseAddress converts a free-form address to an Address, on a best-effort
+// basis. The last line (or last comma-separated part, if there's only one
+// line) is assumed to contain the city, optionally preceded or followed by a
+// postal code, and optionally followed by a country, as in:
+//
+//	Fluffy Street 30
+//	London SW1A 1AA, UK
+//
+// An address with a single part (e.g. "Main St 1 London") is kept as a single
+// line, without a city. If no country is found, the default one is assumed
+// (see SetDefaultAddressCountry). The result may not pass Validate.
+func ParseAddress(s string) Address {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 1 {
+		lines = nil
+		for _, part := range strings.Split(s, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				lines = append(lines, part)
+			}
+		}
+	}
+	a := Address{Country: defaultAddressCountry, freeForm: true}
+	if len(lines) <= 1 {
+		a.Lines = lines
+		return a
+	}
+
+	last := lines[len(lines)-1]
+	if i := strings.LastIndex(last, ","); i >= 0 {
+		if code := countryCode(last[i+1:]); code != "" {
+			a.Country = code
+			last = strings.TrimSpace(last[:i])
+		}
+	} else if len(lines) > 1 {
+		if code := countryCode(last); code != "" {
+			a.Country = code
+			lines = lines[:len(lines)-1]
+			last = lines[len(lines)-1]
+		}
+	}
+	a.City, a.PostalCode = splitPostalCode(last, a.Country)
+	a.Lines = lines[:len(lines)-1]
+	return a
+}
+
+// splitPostalCode separates a postal code of the country from the beginning
+// or end of s, if it's found there.
+func splitPostalCode(s, country string) (rest, postalCode string) {
+	format := postalCodeFormats[country]
+	if format == nil {
+		return s, ""
+	}
+	words := strings.Fields(s)
+	// Postal codes in some countries have a space inside
+	for n := 2; n >= 1; n-- {
+		if len(words) <= n {
+			continue
+		}
+		if code := NormalizePostalCode(strings.Join(words[:n], " "), country); format.MatchString(code) {
+			return strings.Join(words[n:], " "), code
+		}
+		if code := NormalizePostalCode(strings.Join(words[len(words)-n:], " "), country); format.MatchString(code) {
+			return strings.Join(words[:len(words)-n], " "), code
+		}
+	}
+	return s, ""
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    Address
+	}{
+		{
+			"Fluffy Street 30\nLondon, UK",
+			Address{Lines: []string{"Fluffy Street 30"}, City: "London", Country: "GB"},
+		},
+		{
+			"Fluffy Street 30\nFlat 2\nLondon SW1A1AA\nUnited Kingdom",
+			Address{Lines: []string{"Fluffy Street 30", "Flat 2"}, City: "London", PostalCode: "SW1A 1AA", Country: "GB"},
+		},
+		{
+			"ul. Długa 5/7\n00-950 Warszawa",
+			Address{Lines: []string{"ul. Długa 5/7"}, City: "Warszawa", PostalCode: "00-950", Country: "PL"},
+		},
+		{
+			"Hauptstraße 1, 10115 Berlin, DE",
+			Address{Lines: []string{"Hauptstraße 1"}, City: "Berlin", PostalCode: "10115", Country: "DE"},
+		},
+		{
+			"  Some Street 17 \n\n Some City ",
+			Address{Lines: []string{"Some Street 17"}, City: "Some City", Country: "PL"},
+		},
+		{
+			"ADDRESS 2",
+			Address{Lines: []string{"ADDRESS 2"}, Country: "PL"},
+		},
+		{
+			"Main St 1 London",
+			Address{Lines: []string{"Main St 1 London"}, Country: "PL"},
+		},
+	}
+	for _, tt := range tests {
+		tt.want.freeForm = true
+		have := ParseAddress(tt.address)
+		if !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("%q: want %+v, have %+v", tt.address, tt.want, have)
+		}
+	}
+}
+
+func TestAddress_Validate(t *testing.T) {
+	valid := func() Address {
+		return Address{Lines: []string{" Fluffy Street 30 "}, City: "London ", PostalCode: "sw1a1aa", Country: "gb"}
+	}
+	a := valid()
+	err := a.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Address{Lines: []string{"Fluffy Street 30"}, City: "London", PostalCode: "SW1A 1AA", Country: "GB"}
+	if !reflect.DeepEqual(a, want) {
+		t.Errorf("want normalized %+v, have %+v", want, a)
+	}
+
+	tests := []struct {
+		comment string
+		modify  func(a *Address)
+		wantErr string
+	}{
+		{"no lines", func(a *Address) { a.Lines = nil }, "lines"},
+		{"empty line", func(a *Address) { a.Lines = append(a.Lines, " ") }, "lines[1]"},
+		{"too many lines", func(a *Address) { a.Lines = []string{"a", "b", "c", "d"} }, "lines"},
+		{"no city", func(a *Address) { a.City = "" }, "city"},
+		{"no country", func(a *Address) { a.Country = "" }, "country"},
+		{"unknown country", func(a *Address) { a.Country = "XX" }, "country"},
+		{"invalid postal code", func(a *Address) { a.PostalCode = "12345" }, "postal_code"},
+		{"invalid postal code in PL", func(a *Address) { a.Country, a.PostalCode = "PL", "00950" }, "postal_code"},
+		{"too long postal code", func(a *Address) { a.Country, a.PostalCode = "AR", strings.Repeat("1", 17) }, "postal_code"},
+	}
+	for _, tt := range tests {
+		a := valid()
+		tt.modify(&a)
+		err := a.Validate()
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: want error with %q, have: %v", tt.comment, tt.wantErr, err)
+		}
+	}
+
+	// City is optional in free-form addresses, which were valid in v1
+	a = ParseAddress("Main St 1 London")
+	if err := a.Validate(); err != nil {
+		t.Errorf("free-form: unexpected error: %s", err)
+	}
+	a = Address{Lines: []string{"Main St 1 London"}, Country: "PL"}
+	if err := a.Validate(); err == nil || !strings.Contains(err.Error(), "city") {
+		t.Errorf("structured without city: want error, have %v", err)
+	}
+
+	// No validation rules for postal codes in other countries
+	a = Address{Lines: []string{"Av. Corrientes 1234"}, City: "Buenos Aires", PostalCode: "C1043AAZ", Country: "AR"}
+	if err := a.Validate(); err != nil {
+		t.Errorf("AR: unexpected error: %s", err)
+	}
+}
+
+func TestAddress_UnmarshalJSON(t *testing.T) {
+	var a Address
+	err := json.Unmarshal([]byte(`"Fluffy Street 30\nLondon, UK"`), &a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.City != "London" || a.Country != "GB" {
+		t.Errorf("from string: unexpected %+v", a)
+	}
+
+	err = json.Unmarshal([]byte(`{"lines": ["Fluffy Street 30"], "city": "London", "postal_code": "SW1A 1AA", "country": "GB"}`), &a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.PostalCode != "SW1A 1AA" || len(a.Lines) != 1 {
+		t.Errorf("from object: unexpected %+v", a)
+	}
+
+	err = json.Unmarshal([]byte(`{"lines": ["Fluffy Street 30"], "town": "London"}`), &a)
+	if err == nil || !strings.Contains(err.Error(), "town") {
+		t.Errorf("unknown field: want error, have %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// admin wraps a handler of an administrative endpoint, requiring the request
+// to carry the s.AdminToken as a bearer token. If s.AdminToken is empty, the
+// administrative endpoints are disabled.
+func (s *Server) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.AdminToken == "" {
+			RespondError(w, http.StatusForbidden, errors.New("admin API is disabled"))
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			RespondError(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *Server) listTechnologies(w http.ResponseWriter, r *http.Request) {
+	list, err := s.DB.ListTechnologies(r.Context())
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if list == nil {
+		list = []*Technology{}
+	}
+	RespondJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) createTechnology(w http.ResponseWriter, r *http.Request) {
+	var t Technology
+	status, err := DecodeJSON(r, s.maxBodyBytes(), &t)
+	if err != nil {
+		RespondError(w, status, err)
+		return
+	}
+	err = t.Validate()
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.DB.CreateTechnology(r.Context(), &t)
+	if err != nil {
+		if errors.As(err, &ErrConflict{}) {
+			RespondError(w, http.StatusConflict, errors.New("technology with the same .name already exists"))
+			return
+		}
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// Other instances will be notified by the database
+	technologies.Add(t.Name)
+
+	w.Header().Add("Location", s.baseURL(r)+"/v1/admin/technologies/"+t.Name)
+	RespondJSON(w, http.StatusCreated, &t)
+}
+
+func (s *Server) modifyTechnology(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var t Technology
+	status, err := DecodeJSON(r, s.maxBodyBytes(), &t)
+	if err != nil {
+		RespondError(w, status, err)
+		return
+	}
+	err = t.Validate()
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if t.Name != name {
+		RespondError(w, http.StatusBadRequest, errors.New(".name field does not match the value in the URL"))
+		return
+	}
+
+	err = s.DB.ModifyTechnology(r.Context(), &t)
+	if err != nil {
+		if errors.As(err, &ErrNotFound{}) {
+			RespondError(w, http.StatusNotFound, err)
+			return
+		}
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) deleteTechnology(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	err := s.DB.DeleteTechnology(r.Context(), name)
+	if err != nil {
+		switch {
+		case errors.As(err, &ErrNotFound{}):
+			RespondError(w, http.StatusNotFound, err)
+		case errors.As(err, &ErrConflict{}):
+			RespondError(w, http.StatusConflict, err)
+		default:
+			RespondError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	technologies.Remove(name)
+	RespondJSON(w, http.StatusNoContent, nil)
+}
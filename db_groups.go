@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-pg/pg/v9"
+)
+
+func (db *PostgresDB) ListGroups(ctx context.Context) ([]*Group, error) {
+	var list []*Group
+	err := db.conn(ctx).ModelContext(ctx, &list).Order("name").Select()
+	if err != nil {
+		return nil, fmt.Errorf("listing groups: %w", err)
+	}
+	return list, nil
+}
+
+func (db *PostgresDB) GetGroup(ctx context.Context, name string) (*Group, error) {
+	g := &Group{Name: name}
+	err := db.conn(ctx).ModelContext(ctx, g).WherePK().Select()
+	if err == pg.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting group: %w", err)
+	}
+	return g, nil
+}
+
+func (db *PostgresDB) CreateGroup(ctx context.Context, g *Group) error {
+	_, err := db.conn(ctx).ModelContext(ctx, g).Insert()
+	if err != nil {
+		if pgErrCode(err) == "23505" {
+			err = ErrConflict{wraperr{err}}
+		}
+		return fmt.Errorf("creating group: %w", err)
+	}
+	return nil
+}
+
+func (db *PostgresDB) ModifyGroup(ctx context.Context, g *Group) error {
+	result, err := db.conn(ctx).ModelContext(ctx, g).WherePK().Update()
+	if err != nil {
+		return fmt.Errorf("modifying group: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound{wraperr{fmt.Errorf("group not found: %s", g.Name)}}
+	}
+	return nil
+}
+
+// DeleteGroup removes a group together with all its memberships.
+func (db *PostgresDB) DeleteGroup(ctx context.Context, name string) error {
+	result, err := db.conn(ctx).ModelContext(ctx, &Group{Name: name}).WherePK().Delete()
+	if err != nil {
+		return fmt.Errorf("deleting group: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound{wraperr{fmt.Errorf("group not found: %s", name)}}
+	}
+	return nil
+}
+
+// AddGroupMember adds the active user with the specified public ID to a
+// group. Adding a user who is already a member is not an error.
+func (db *PostgresDB) AddGroupMember(ctx context.Context, group, userID string) error {
+	id, err := db.activeUserID(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("adding group member: %w", err)
+	}
+	_, err = db.conn(ctx).ExecContext(ctx, `
+		INSERT INTO group_members (group_name, user_id) VALUES (?, ?)
+		ON CONFLICT DO NOTHING`, group, id)
+	if err != nil {
+		// foreign_key_violation
+		if pgErrCode(err) == "23503" {
+			err = ErrNotFound{wraperr{fmt.Errorf("group not found: %s", group)}}
+		}
+		return fmt.Errorf("adding group member: %w", err)
+	}
+	return nil
+}
+
+// RemoveGroupMember removes the user with the specified public ID from a
+// group. Also deleted users can be removed.
+func (db *PostgresDB) RemoveGroupMember(ctx context.Context, group, userID string) error {
+	result, err := db.conn(ctx).ExecContext(ctx, `
+		DELETE FROM group_members
+		WHERE group_name = ? AND user_id = (SELECT id FROM users WHERE public_id = ?)`, group, userID)
+	if err != nil {
+		return fmt.Errorf("removing group member: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound{wraperr{fmt.Errorf("user %s is not a member of group %s", userID, group)}}
+	}
+	return nil
+}
+
+// ListUserGroups returns the groups of the active user with the specified
+// public ID.
+func (db *PostgresDB) ListUserGroups(ctx context.Context, userID string) ([]*Group, error) {
+	id, err := db.activeUserID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("listing user groups: %w", err)
+	}
+	var list []*Group
+	err = db.conn(ctx).ModelContext(ctx, &list).
+		Join(`JOIN group_members AS gm ON gm.group_name = "group".name`).
+		Where(`gm.user_id = ?`, id).
+		Order("name").
+		Select()
+	if err != nil {
+		return nil, fmt.Errorf("listing user groups: %w", err)
+	}
+	return list, nil
+}
+
+// activeUserID returns the internal ID of the active user with the specified
+// public ID, or ErrNotFound.
+func (db *PostgresDB) activeUserID(ctx context.Context, publicID string) (int64, error) {
+	var id int64
+	_, err := db.conn(ctx).QueryOneContext(ctx, pg.Scan(&id),
+		`SELECT id FROM users WHERE public_id = ? AND deleted IS NULL`, publicID)
+	if err == pg.ErrNoRows {
+		return 0, ErrNotFound{wraperr{fmt.Errorf("user not found: %s", publicID)}}
+	}
+	return id, err
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/go-pg/pg/v9"
+)
+
+// migration describes a single step of upgrading the database schema.
+// Migrations are applied in order of increasing version, and each version is
+// applied only once.
+//
+// NOTE: never modify a migration which may have already been applied to some
+// database; instead, append a new one at the end of the migrations list.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *pg.Tx) error
+}
+
+// migrations lists all schema changes, in order.
+var migrations = []migration{
+	{1, "create users table", execSQL(`
+		CREATE TABLE IF NOT EXISTS users (
+			id bigserial PRIMARY KEY,
+			name text NOT NULL,
+			surname text NOT NULL,
+			email text NOT NULL,
+			password text NOT NULL,
+			birthday timestamptz NOT NULL,
+			address text NOT NULL,
+			phone text,
+			technology text NOT NULL,
+			deleted timestamptz
+		);
+	`)},
+	// See:
+	// - https://stackoverflow.com/q/24674281 - ...IF NOT EXISTS...
+	// - https://stackoverflow.com/a/8289253  - ...WHERE ? IS NULL
+	{2, "allow only one active user per email", execSQL(`
+		CREATE UNIQUE INDEX IF NOT EXISTS users_only_one_active
+			ON users (email)
+			WHERE deleted IS NULL;
+	`)},
+	// Note: gen_random_uuid() requires the pgcrypto extension before
+	// Postgres 13; existing rows are rare enough to use md5 instead. New
+	// rows get their IDs generated by the service.
+	{3, "add public user IDs", execSQL(`
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS public_id uuid;
+		UPDATE users SET public_id = md5(random()::text || clock_timestamp()::text || id::text)::uuid
+			WHERE public_id IS NULL;
+		ALTER TABLE users ALTER COLUMN public_id SET NOT NULL;
+		CREATE UNIQUE INDEX IF NOT EXISTS users_public_id ON users (public_id);
+	`)},
+	// Note: existing rows are normalized only approximately, as IDNA
+	// conversion is not available in SQL. If active users with emails
+	// differing only in case exist, the migration fails and they must be
+	// resolved manually.
+	{4, "enforce uniqueness of normalized emails", execSQL(`
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS email_norm text;
+		UPDATE users SET email_norm = lower(trim(email))
+			WHERE email_norm IS NULL;
+		ALTER TABLE users ALTER COLUMN email_norm SET NOT NULL;
+		CREATE UNIQUE INDEX IF NOT EXISTS users_only_one_active_norm
+			ON users (email_norm)
+			WHERE deleted IS NULL;
+		DROP INDEX IF EXISTS users_only_one_active;
+	`)},
+	{5, "convert phone numbers to E.164 format", normalizePhones},
+	{6, "create technologies catalog", execSQL(`
+		CREATE TABLE IF NOT EXISTS technologies (
+			name text PRIMARY KEY,
+			description text NOT NULL DEFAULT ''
+		);
+		INSERT INTO technologies (name)
+			VALUES ('go'), ('java'), ('js'), ('php')
+			ON CONFLICT DO NOTHING;
+		INSERT INTO technologies (name)
+			SELECT DISTINCT technology FROM users
+			ON CONFLICT DO NOTHING;
+		ALTER TABLE users
+			ADD CONSTRAINT users_technology_fkey
+			FOREIGN KEY (technology) REFERENCES technologies (name);
+		CREATE INDEX IF NOT EXISTS users_technology ON users (technology);
+
+		CREATE OR REPLACE FUNCTION notify_technologies_changed() RETURNS trigger AS $$
+		BEGIN
+			PERFORM pg_notify('` + technologiesChannel + `', '');
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+		CREATE TRIGGER technologies_changed
+			AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON technologies
+			FOR EACH STATEMENT EXECUTE PROCEDURE notify_technologies_changed();
+	`)},
+	// Note: users.technology is kept as the primary technology, for
+	// compatibility with clients of the single-technology API.
+	{7, "allow multiple technologies per user", execSQL(`
+		CREATE TABLE IF NOT EXISTS user_technologies (
+			user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			technology text NOT NULL REFERENCES technologies (name),
+			level smallint NOT NULL DEFAULT 0,
+			since date,
+			PRIMARY KEY (user_id, technology)
+		);
+		CREATE INDEX IF NOT EXISTS user_technologies_technology
+			ON user_technologies (technology, level);
+		INSERT INTO user_technologies (user_id, technology)
+			SELECT id, technology FROM users
+			ON CONFLICT DO NOTHING;
+	`)},
+	{8, "convert addresses to structured JSON", structureAddresses},
+	// Note: jsonb_path_ops indexes support only containment (@>) queries,
+	// but are smaller and faster than the default jsonb_ops.
+	{9, "add users metadata", execSQL(`
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS metadata jsonb NOT NULL DEFAULT '{}';
+		CREATE INDEX IF NOT EXISTS users_metadata ON users USING gin (metadata jsonb_path_ops);
+	`)},
+	{10, "create groups", execSQL(`
+		CREATE TABLE IF NOT EXISTS groups (
+			name text PRIMARY KEY,
+			description text NOT NULL DEFAULT ''
+		);
+		CREATE TABLE IF NOT EXISTS group_members (
+			group_name text NOT NULL REFERENCES groups (name) ON DELETE CASCADE,
+			user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			added timestamptz NOT NULL DEFAULT now(),
+			PRIMARY KEY (group_name, user_id)
+		);
+		CREATE INDEX IF NOT EXISTS group_members_user_id ON group_members (user_id);
+	`)},
+	// Note: user_versions must have all the columns of users, in the same
+	// order; when adding a column to users, add it also to user_versions.
+	// History of changes made before this migration is not known, so the
+	// initial versions start at the time of migration. Technologies are
+	// stored in the JSON format of UserTechnology.
+	{11, "record user versions", execSQL(`
+		CREATE TABLE IF NOT EXISTS user_versions (
+			version_id bigserial PRIMARY KEY,
+			LIKE users,
+			valid_from timestamptz NOT NULL,
+			valid_to timestamptz,
+			technologies jsonb NOT NULL DEFAULT '[]'
+		);
+		CREATE INDEX IF NOT EXISTS user_versions_id ON user_versions (id, valid_from);
+		CREATE INDEX IF NOT EXISTS user_versions_email_norm ON user_versions (email_norm, valid_from);
+		CREATE INDEX IF NOT EXISTS user_versions_valid ON user_versions (valid_from, valid_to);
+		INSERT INTO user_versions
+			SELECT nextval('user_versions_version_id_seq'), u.*, now(), NULL, coalesce(t.technologies, '[]')
+			FROM users AS u
+			LEFT JOIN (
+				SELECT user_id, jsonb_agg(jsonb_strip_nulls(jsonb_build_object(
+					'name', technology,
+					'level', (ARRAY['beginner', 'intermediate', 'advanced', 'expert'])[nullif(level, 0)],
+					'since', to_char(since, 'YYYY-MM-DD"T00:00:00Z"')
+				)) ORDER BY level DESC, technology) AS technologies
+				FROM user_technologies
+				GROUP BY user_id
+			) AS t ON t.user_id = u.id;
+	`)},
+	// Note: changes made before this migration are not published as events.
+	// The user_event_offsets table tracks progress of EventPublishers.
+	{12, "create user events outbox", execSQL(`
+		CREATE TABLE IF NOT EXISTS user_events (
+			id bigserial PRIMARY KEY,
+			type text NOT NULL,
+			user_id uuid NOT NULL,
+			time timestamptz NOT NULL DEFAULT now(),
+			data jsonb NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS user_events_user_id ON user_events (user_id, id);
+		CREATE TABLE IF NOT EXISTS user_event_offsets (
+			consumer text PRIMARY KEY,
+			last_id bigint NOT NULL DEFAULT 0
+		);
+
+		CREATE OR REPLACE FUNCTION notify_user_events_inserted() RETURNS trigger AS $$
+		BEGIN
+			PERFORM pg_notify('` + userEventsChannel + `', '');
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+		CREATE TRIGGER user_events_inserted
+			AFTER INSERT ON user_events
+			FOR EACH STATEMENT EXECUTE PROCEDURE notify_user_events_inserted();
+	`)},
+	// Note: webhook_deliveries is both the queue of pending deliveries and
+	// the log of finished ones.
+	{13, "create webhooks", execSQL(`
+		CREATE TABLE IF NOT EXISTS webhooks (
+			id uuid PRIMARY KEY,
+			url text NOT NULL,
+			event_types text[] NOT NULL DEFAULT '{}',
+			secret text NOT NULL,
+			created timestamptz NOT NULL DEFAULT now()
+		);
+		CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id bigserial PRIMARY KEY,
+			webhook_id uuid NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+			event_id bigint NOT NULL REFERENCES user_events (id),
+			state text NOT NULL DEFAULT 'pending',
+			attempts int NOT NULL DEFAULT 0,
+			next_attempt timestamptz DEFAULT now(),
+			last_attempt timestamptz,
+			last_status int,
+			last_error text,
+			created timestamptz NOT NULL DEFAULT now()
+		);
+		CREATE INDEX IF NOT EXISTS webhook_deliveries_due
+			ON webhook_deliveries (next_attempt)
+			WHERE state = 'pending';
+		CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id
+			ON webhook_deliveries (webhook_id, id);
+	`)},
+	// Note: emails of existing users were never verified, so they are left
+	// pending; verification emails can be requested for them via the API.
+	{14, "add email verification", execSQL(`
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified timestamptz;
+		ALTER TABLE user_versions ADD COLUMN IF NOT EXISTS email_verified timestamptz;
+	`)},
+	// Note: events are recorded in user_events_pending, and moved to
+	// user_events by one sequencer at a time, which assigns their IDs in
+	// order of commit (see sequenceUserEvents).
+	{15, "sequence user events by commit", execSQL(`
+		CREATE TABLE IF NOT EXISTS user_events_pending (
+			seq bigserial PRIMARY KEY,
+			type text NOT NULL,
+			user_id uuid NOT NULL,
+			time timestamptz NOT NULL DEFAULT now(),
+			data jsonb NOT NULL
+		);
+
+		CREATE OR REPLACE FUNCTION notify_user_events_pending_inserted() RETURNS trigger AS $$
+		BEGIN
+			PERFORM pg_notify('` + userEventsPendingChannel + `', '');
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+		CREATE TRIGGER user_events_pending_inserted
+			AFTER INSERT ON user_events_pending
+			FOR EACH STATEMENT EXECUTE PROCEDURE notify_user_events_pending_inserted();
+	`)},
+}
+
+// normalizePhones converts phone numbers stored before they were validated to
+// the E.164 format. Numbers which cannot be parsed are left untouched.
+func normalizePhones(tx *pg.Tx) error {
+	var rows []struct {
+		ID    int64
+		Phone string
+	}
+	_, err := tx.Query(&rows, `SELECT id, phone FROM users WHERE phone IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	invalid := 0
+	for _, row := range rows {
+		phone, err := NormalizePhone(row.Phone)
+		if err != nil {
+			invalid++
+			continue
+		}
+		if phone == row.Phone {
+			continue
+		}
+		_, err = tx.Exec(`UPDATE users SET phone = ? WHERE id = ?`, phone, row.ID)
+		if err != nil {
+			return err
+		}
+	}
+	if invalid > 0 {
+		log.Printf("WARNING: %d invalid phone numbers left unchanged in users table", invalid)
+	}
+	return nil
+}
+
+// structureAddresses converts free-form addresses to JSON objects (see
+// ParseAddress). Addresses which don't pass validation after conversion are
+// kept as parsed, and must be fixed by their users on next modification.
+func structureAddresses(tx *pg.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE users ADD COLUMN address_json jsonb`)
+	if err != nil {
+		return err
+	}
+	var rows []struct {
+		ID      int64
+		Address string
+	}
+	_, err = tx.Query(&rows, `SELECT id, address FROM users`)
+	if err != nil {
+		return err
+	}
+	invalid := 0
+	for _, row := range rows {
+		address := ParseAddress(row.Address)
+		if address.Validate() != nil {
+			invalid++
+		}
+		_, err = tx.Exec(`UPDATE users SET address_json = ? WHERE id = ?`, &address, row.ID)
+		if err != nil {
+			return err
+		}
+	}
+	if invalid > 0 {
+		log.Printf("WARNING: %d addresses in users table could not be fully parsed", invalid)
+	}
+	_, err = tx.Exec(`
+		ALTER TABLE users DROP COLUMN address;
+		ALTER TABLE users RENAME COLUMN address_json TO address;
+		ALTER TABLE users ALTER COLUMN address SET NOT NULL;
+		CREATE INDEX IF NOT EXISTS users_address_country ON users ((address->>'country'));
+		CREATE INDEX IF NOT EXISTS users_address_city ON users (lower(address->>'city'));
+	`)
+	return err
+}
+
+// execSQL returns a migration step executing the provided SQL statements.
+func execSQL(sql string) func(tx *pg.Tx) error {
+	return func(tx *pg.Tx) error {
+		_, err := tx.Exec(sql)
+		return err
+	}
+}
+
+// migrate applies all pending migrations in a single transaction. Concurrent
+// calls (also from different processes) are serialized using a table lock.
+func (db *PostgresDB) migrate() error {
+	_, err := db.pg.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version int PRIMARY KEY,
+			name text NOT NULL,
+			applied timestamptz NOT NULL DEFAULT now()
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("creating migrations table: %w", err)
+	}
+
+	return db.pg.RunInTransaction(func(tx *pg.Tx) error {
+		_, err := tx.Exec(`LOCK TABLE schema_migrations IN EXCLUSIVE MODE`)
+		if err != nil {
+			return fmt.Errorf("locking migrations table: %w", err)
+		}
+		var current int
+		_, err = tx.QueryOne(pg.Scan(&current), `SELECT coalesce(max(version), 0) FROM schema_migrations`)
+		if err != nil {
+			return fmt.Errorf("reading schema version: %w", err)
+		}
+
+		for _, m := range migrations {
+			if m.version <= current {
+				continue
+			}
+			log.Printf("applying database migration %d: %s", m.version, m.name)
+			err := m.up(tx)
+			if err != nil {
+				return fmt.Errorf("applying migration %d (%s): %w", m.version, m.name, err)
+			}
+			_, err = tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.version, m.name)
+			if err != nil {
+				return fmt.Errorf("recording migration %d: %w", m.version, err)
+			}
+		}
+		return nil
+	})
+}
+
+// PendingMigrations returns the number of known migrations not yet applied to
+// the database.
+func (db *PostgresDB) PendingMigrations(ctx context.Context) (int, error) {
+	var current int
+	_, err := db.pg.QueryOneContext(ctx, pg.Scan(&current), `SELECT coalesce(max(version), 0) FROM schema_migrations`)
+	if err != nil {
+		return 0, fmt.Errorf("reading schema version: %w", err)
+	}
+	pending := 0
+	for _, m := range migrations {
+		if m.version > current {
+			pending++
+		}
+	}
+	return pending, nil
+}
@@ -2,77 +2,348 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/go-pg/pg/v9"
 	"github.com/go-pg/pg/v9/orm"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // PostgresDB represents a database containing User objects. PostgresDB intends
 // to implement the Database interface.
 type PostgresDB struct {
 	pg *pg.DB
+
+	closing    chan struct{} // closed by Close, to stop background goroutines
+	background sync.WaitGroup
 }
 
 var _ Database = (*PostgresDB)(nil)
 
+// PostgresConfig contains connection settings which cannot be expressed in a
+// connection URL understood by pg.ParseURL. Zero values keep the defaults of
+// the pg package.
+type PostgresConfig struct {
+	PoolSize     int
+	MinIdleConns int
+	PoolTimeout  time.Duration
+	IdleTimeout  time.Duration
+	MaxConnAge   time.Duration
+
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// StatementTimeout is applied on every new connection via Postgres
+	// 'statement_timeout' setting.
+	StatementTimeout time.Duration
+
+	// SSLMode overrides the 'sslmode' parameter of the connection URL. It must
+	// be one of: disable allow prefer require verify-ca verify-full
+	SSLMode string
+	// SSLRootCert is a PEM bundle of CAs used for verifying the server
+	// certificate in verify-ca and verify-full modes. If empty, system CAs are
+	// used.
+	SSLRootCert string
+}
+
+// Apply modifies options according to settings in c.
+func (c PostgresConfig) Apply(options *pg.Options) error {
+	if c.PoolSize != 0 {
+		options.PoolSize = c.PoolSize
+	}
+	if c.MinIdleConns != 0 {
+		options.MinIdleConns = c.MinIdleConns
+	}
+	if c.PoolTimeout != 0 {
+		options.PoolTimeout = c.PoolTimeout
+	}
+	if c.IdleTimeout != 0 {
+		options.IdleTimeout = c.IdleTimeout
+	}
+	if c.MaxConnAge != 0 {
+		options.MaxConnAge = c.MaxConnAge
+	}
+	if c.DialTimeout != 0 {
+		options.DialTimeout = c.DialTimeout
+	}
+	if c.ReadTimeout != 0 {
+		options.ReadTimeout = c.ReadTimeout
+	}
+	if c.WriteTimeout != 0 {
+		options.WriteTimeout = c.WriteTimeout
+	}
+
+	if c.StatementTimeout != 0 {
+		ms := c.StatementTimeout.Milliseconds()
+		if ms < 1 {
+			return fmt.Errorf("statement timeout too short: %s", c.StatementTimeout)
+		}
+		onConnect := options.OnConnect
+		options.OnConnect = func(conn *pg.Conn) error {
+			_, err := conn.Exec(fmt.Sprintf("SET statement_timeout = %d", ms))
+			if err != nil {
+				return fmt.Errorf("setting statement_timeout: %w", err)
+			}
+			if onConnect != nil {
+				return onConnect(conn)
+			}
+			return nil
+		}
+	}
+
+	host, _, err := net.SplitHostPort(options.Addr)
+	if err != nil {
+		host = options.Addr
+	}
+	switch c.SSLMode {
+	case "":
+		// Keep mode from the URL. Note: pg.ParseURL does not set ServerName
+		// for verify-ca & verify-full modes, which makes the TLS handshake
+		// fail, so we fill it in.
+		if options.TLSConfig != nil && !options.TLSConfig.InsecureSkipVerify && options.TLSConfig.ServerName == "" {
+			options.TLSConfig.ServerName = host
+		}
+		if c.SSLRootCert != "" {
+			return errors.New("SSL root certificate requires sslmode verify-ca or verify-full")
+		}
+		return nil
+	case "disable":
+		options.TLSConfig = nil
+	case "allow", "prefer", "require":
+		// Same as pg.ParseURL
+		options.TLSConfig = &tls.Config{InsecureSkipVerify: true} //nolint
+	case "verify-ca", "verify-full":
+		var roots *x509.CertPool
+		if c.SSLRootCert != "" {
+			pem, err := ioutil.ReadFile(c.SSLRootCert)
+			if err != nil {
+				return fmt.Errorf("loading SSL root certificate: %w", err)
+			}
+			roots = x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("loading SSL root certificate: no certificates found in %s", c.SSLRootCert)
+			}
+		}
+		if c.SSLMode == "verify-full" {
+			options.TLSConfig = &tls.Config{RootCAs: roots, ServerName: host}
+			return nil
+		}
+		// verify-ca: verify the certificate chain, but not the host name
+		options.TLSConfig = &tls.Config{
+			InsecureSkipVerify: true, //nolint - verified in VerifyPeerCertificate below
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				return verifyCertChain(rawCerts, roots)
+			},
+		}
+	default:
+		return fmt.Errorf("unsupported sslmode %q, must be one of: disable allow prefer require verify-ca verify-full", c.SSLMode)
+	}
+	if c.SSLRootCert != "" && c.SSLMode != "verify-ca" && c.SSLMode != "verify-full" {
+		return errors.New("SSL root certificate requires sslmode verify-ca or verify-full")
+	}
+	return nil
+}
+
+// verifyCertChain verifies that the first of rawCerts is signed by one of the
+// roots, with intermediates taken from the remaining rawCerts.
+func verifyCertChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no server certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("parsing server certificate: %w", err)
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// QueryLogMode specifies which SQL queries are written to the log.
+type QueryLogMode string
+
+const (
+	QueryLogOff  QueryLogMode = "off"
+	QueryLogSlow QueryLogMode = "slow" // only queries taking at least QueryLog.SlowThreshold
+	QueryLogAll  QueryLogMode = "all"
+)
+
+// QueryLog configures logging of SQL queries. Values of sensitive columns are
+// always redacted in the logged queries (see sensitiveColumns).
+type QueryLog struct {
+	Mode          QueryLogMode
+	SlowThreshold time.Duration
+}
+
 // ConnectPostgres opens a conection to a PostgreSQL database described by
 // provided options, and creates a schema for storing User objects in the
-// database if not yet present.
+// database if not yet present. If the database is not reachable, connecting is
+// retried with an exponential backoff for up to retryFor.
 //
 // TODO: [LATER] use generic options, not ones specific to pg package
-func ConnectPostgres(options *pg.Options) (*PostgresDB, error) {
-	db := &PostgresDB{
-		pg: pg.Connect(options),
+func ConnectPostgres(options *pg.Options, retryFor time.Duration, queryLog QueryLog) (*PostgresDB, error) {
+	switch queryLog.Mode {
+	case QueryLogOff, QueryLogSlow, QueryLogAll:
+	default:
+		return nil, fmt.Errorf("unsupported query log mode %q, must be one of: off slow all", queryLog.Mode)
 	}
-	// TODO: enable SQL logger only if requested via flag
-	db.pg.AddQueryHook(pgLogger{})
 
-	// FIXME: create all below schema-related stuff as part of one DDL transaction
-	// TODO: add indexes for speeding up searches
+	db := &PostgresDB{
+		pg:      pg.Connect(options),
+		closing: make(chan struct{}),
+	}
+	db.pg.AddQueryHook(pgQueryHook{queryLog})
 
-	// Create main schema
-	// TODO: [LATER] switch to proper migrations, e.g. https://github.com/go-pg/migrations or https://github.com/robinjoseph08/go-pg-migrations
-	err := db.pg.CreateTable((*User)(nil), &orm.CreateTableOptions{
-		IfNotExists: true,
-	})
+	err := db.waitReachable(retryFor)
 	if err != nil {
 		db.pg.Close()
-		return nil, fmt.Errorf("creating schemas: %w", err)
+		return nil, fmt.Errorf("connecting: %w", err)
 	}
 
-	// Add unique indexes
-	// See:
-	// - https://github.com/go-pg/pg/wiki/Writing-Queries#executing-custom-queries
-	// - https://stackoverflow.com/q/24674281 - ...IF NOT EXISTS...
-	// - https://stackoverflow.com/a/8289253  - ...WHERE ? IS NULL
-	_, err = db.pg.Model((*User)(nil)).Exec(`
-		CREATE UNIQUE INDEX IF NOT EXISTS users_only_one_active
-			ON ?TableName (email)
-			WHERE deleted IS NULL;
-	`)
+	// TODO: add indexes for speeding up searches
+	err = db.migrate()
 	if err != nil {
 		db.pg.Close()
-		return nil, fmt.Errorf("creating indexes: %w", err)
+		return nil, fmt.Errorf("migrating schema: %w", err)
 	}
 
 	return db, nil
 }
 
+// waitReachable pings the database until it responds, or until the retryFor
+// period passes, in which case the last error is returned.
+func (db *PostgresDB) waitReachable(retryFor time.Duration) error {
+	const maxBackoff = 10 * time.Second
+	var (
+		deadline = time.Now().Add(retryFor)
+		backoff  = 250 * time.Millisecond
+	)
+	for {
+		err := db.Ping(context.Background())
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		log.Printf("database not reachable, retrying in %s: %s", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Ping verifies that the database is reachable.
+func (db *PostgresDB) Ping(ctx context.Context) error {
+	_, err := db.conn(ctx).ExecContext(ctx, `SELECT 1`)
+	if err != nil {
+		return fmt.Errorf("pinging database: %w", err)
+	}
+	return nil
+}
+
+// PoolStats returns statistics of the database connection pool.
+func (db *PostgresDB) PoolStats() *pg.PoolStats {
+	return db.pg.PoolStats()
+}
+
 func (db *PostgresDB) Close() error {
+	close(db.closing)
+	db.background.Wait()
 	return db.pg.Close()
 }
 
-func (db *PostgresDB) ListUsers(filter UserFilter) ([]*User, error) {
-	var users []*User
-	query := db.pg.Model(&users)
+func (db *PostgresDB) ListUsers(ctx context.Context, filter UserFilter) ([]*User, error) {
+	var (
+		users    []*User
+		versions []*userVersion
+		query    *orm.Query
+	)
+	if filter.AsOf != nil {
+		// Note: user_versions has the same columns as users, and the same
+		// alias in queries, so the filters below work on both
+		query = db.conn(ctx).ModelContext(ctx, &versions).
+			Where(`valid_from <= ?`, *filter.AsOf).
+			Where(`valid_to IS NULL OR valid_to > ?`, *filter.AsOf)
+	} else {
+		query = db.conn(ctx).ModelContext(ctx, &users)
+	}
 
 	if filter.Technology != nil {
 		query.Where(`technology = ?`, *filter.Technology)
 	}
+	if filter.Phone != nil {
+		query.Where(`phone = ?`, *filter.Phone)
+	}
+	if filter.Country != nil {
+		query.Where(`address->>'country' = ?`, *filter.Country)
+	}
+	if filter.City != nil {
+		query.Where(`lower(address->>'city') = lower(?)`, *filter.City)
+	}
+	if filter.Group != nil {
+		query.Where(`EXISTS (SELECT 1 FROM group_members AS gm WHERE gm.user_id = "user".id AND gm.group_name = ?)`, *filter.Group)
+	}
+	// Note: containment (@>) queries are served by the GIN index on metadata
+	keys := make([]string, 0, len(filter.Metadata))
+	for key := range filter.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var values []json.RawMessage
+		for _, v := range filter.Metadata[key] {
+			values = append(values, metadataFilterValues(v)...)
+		}
+		query.WhereGroup(func(q *orm.Query) (*orm.Query, error) {
+			for _, v := range values {
+				q.WhereOr(`metadata @> ?`, Metadata{key: v})
+			}
+			return q, nil
+		})
+	}
+	if len(filter.Technologies) > 0 {
+		// Count how many of the requested technologies the user knows well
+		// enough
+		const known = `(SELECT count(*) FROM user_technologies AS ut
+			WHERE ut.user_id = "user".id AND ut.technology IN (?) AND ut.level >= ?)`
+		if filter.AllTechnologies {
+			query.Where(known+` = ?`, pg.In(filter.Technologies), filter.MinLevel, len(filter.Technologies))
+		} else {
+			query.Where(known+` > 0`, pg.In(filter.Technologies), filter.MinLevel)
+		}
+	}
+	if filter.Verified != nil {
+		if *filter.Verified {
+			query.Where(`email_verified IS NOT NULL`)
+		} else {
+			query.Where(`email_verified IS NULL`)
+		}
+	}
 	if filter.Deleted != nil {
 		if *filter.Deleted {
 			query.Where(`deleted IS NOT NULL`)
@@ -85,18 +356,81 @@ func (db *PostgresDB) ListUsers(filter UserFilter) ([]*User, error) {
 	if err != nil {
 		return nil, fmt.Errorf("listing users: %w", err)
 	}
+	if filter.AsOf != nil {
+		for _, v := range versions {
+			users = append(users, v.user())
+		}
+		return users, nil
+	}
+	err = db.loadTechnologies(ctx, users)
+	if err != nil {
+		return nil, fmt.Errorf("listing users: %w", err)
+	}
 	return users, nil
 }
 
-func (db *PostgresDB) GetUser(email string) (*User, error) {
+// loadTechnologies fills the Technologies field of users.
+func (db *PostgresDB) loadTechnologies(ctx context.Context, users []*User) error {
+	if len(users) == 0 {
+		return nil
+	}
+	byID := make(map[int64]*User, len(users))
+	ids := make([]int64, len(users))
+	for i, u := range users {
+		byID[u.ID] = u
+		ids[i] = u.ID
+		u.Technologies = []UserTechnology{}
+	}
+	var list []UserTechnology
+	err := db.conn(ctx).ModelContext(ctx, &list).
+		Where(`user_id IN (?)`, pg.In(ids)).
+		Order("user_id", "level DESC", "technology").
+		Select()
+	if err != nil {
+		return fmt.Errorf("loading technologies: %w", err)
+	}
+	for _, t := range list {
+		u := byID[t.UserID]
+		u.Technologies = append(u.Technologies, t)
+	}
+	return nil
+}
+
+// saveTechnologies replaces technologies of the user with u.Technologies.
+func saveTechnologies(ctx context.Context, tx orm.DB, u *User) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM user_technologies WHERE user_id = ?`, u.ID)
+	if err != nil {
+		return err
+	}
+	if len(u.Technologies) == 0 {
+		return nil
+	}
+	for i := range u.Technologies {
+		u.Technologies[i].UserID = u.ID
+	}
+	_, err = tx.ModelContext(ctx, &u.Technologies).Insert()
+	return err
+}
+
+func (db *PostgresDB) GetUser(ctx context.Context, email string) (*User, error) {
+	return db.getUser(ctx, "GetUser", "email_norm", emailLookupKey(email))
+}
+
+func (db *PostgresDB) GetUserByID(ctx context.Context, id string) (*User, error) {
+	return db.getUser(ctx, "GetUserByID", "public_id", id)
+}
+
+// getUser returns the active user with the specified value in column, or nil
+// if not found.
+func (db *PostgresDB) getUser(ctx context.Context, op, column, value string) (*User, error) {
 	// TODO: [LATER] is there a smarter way to return 0..1 records with pg package?
 	var users []*User
-	err := db.pg.Model(&users).
-		Where(`email = ?`, email).
+	err := db.conn(ctx).ModelContext(ctx, &users).
+		Where(`? = ?`, pg.Ident(column), value).
 		Where(`deleted IS NULL`).
 		Select()
 	if err != nil {
-		log.Printf("GetUser: %#v", err)
+		logf(ctx, "%s: %#v", op, err)
 		return nil, fmt.Errorf("getting user: %w", err)
 	}
 
@@ -104,17 +438,35 @@ func (db *PostgresDB) GetUser(email string) (*User, error) {
 	case 0:
 		return nil, nil
 	case 1:
+		err := db.loadTechnologies(ctx, users)
+		if err != nil {
+			return nil, fmt.Errorf("getting user: %w", err)
+		}
 		return users[0], nil
 	default:
 		// TODO: [LATER] emit an error ID to logs and to Errorf, for cross-referencing
 		// TODO: [LATER] consider printing a few of the returned users to logs for easier debugging (though GDPR)
-		log.Printf("CRIT: multiple rows returned in GetUser(email=%q): %d", email, len(users))
+		logf(ctx, "CRIT: multiple rows returned in %s(%s=%q): %d", op, column, value, len(users))
 		return nil, fmt.Errorf("Internal Server Error")
 	}
 }
 
-func (db *PostgresDB) CreateUser(u *User) error {
-	err := db.pg.Insert(u)
+// CreateUser inserts u into the database, assigning it a new PublicID.
+func (db *PostgresDB) CreateUser(ctx context.Context, u *User) error {
+	u.PublicID = newPublicID()
+	u.EmailNorm = emailLookupKey(*u.Email)
+	u.EmailVerified = nil
+	err := db.inTx(ctx, func(tx orm.DB) error {
+		_, err := tx.ModelContext(ctx, u).Insert()
+		if err != nil {
+			return err
+		}
+		err = saveTechnologies(ctx, tx, u)
+		if err != nil {
+			return err
+		}
+		return recordChange(ctx, tx, u.ID, UserCreated)
+	})
 	// TODO: what happens if unique constraint violated?
 	if err != nil {
 		// If the error is a violation of UNIQUE constraint, wrap it in an
@@ -124,58 +476,207 @@ func (db *PostgresDB) CreateUser(u *User) error {
 			err = ErrConflict{wraperr{err}}
 			return fmt.Errorf("creating user: %w", err)
 		}
-		log.Printf("CreateUser: %#v", err)
+		// foreign_key_violation, e.g. technology removed concurrently
+		if pgErrCode(err) == "23503" {
+			err = ErrInvalid{wraperr{err}}
+			return fmt.Errorf("creating user: %w", err)
+		}
+		logf(ctx, "CreateUser: %#v", err)
 		return fmt.Errorf("creating user: %w", err)
 	}
 	return nil
 }
 
-func (db *PostgresDB) ModifyUser(u *User) error {
-	result, err := db.pg.Model(u).
-		Where(`email = ?`, *u.Email).
-		Where(`deleted IS NULL`).
-		Update()
+func (db *PostgresDB) ModifyUser(ctx context.Context, u *User) error {
+	return db.modifyUser(ctx, u, "ModifyUser", "email_norm", emailLookupKey(*u.Email))
+}
+
+// ModifyUserByID updates the active user with the specified PublicID. Unlike
+// ModifyUser, it allows changing the email of the user.
+func (db *PostgresDB) ModifyUserByID(ctx context.Context, id string, u *User) error {
+	err := db.modifyUser(ctx, u, "ModifyUserByID", "public_id", id)
 	if err != nil {
-		log.Printf("ModifyUser: %#v", err)
+		return err
+	}
+	u.PublicID = id
+	return nil
+}
+
+func (db *PostgresDB) modifyUser(ctx context.Context, u *User, op, column, value string) error {
+	u.EmailNorm = emailLookupKey(*u.Email)
+	excluded := []string{"public_id"}
+	if u.Metadata == nil {
+		excluded = append(excluded, "metadata")
+	}
+	var rows int
+	err := db.inTx(ctx, func(tx orm.DB) error {
+		result, err := tx.ModelContext(ctx, u).
+			ExcludeColumn(excluded...).
+			// Changing the email makes it unverified again
+			Value("email_verified", `CASE WHEN email_norm = ? THEN email_verified END`, u.EmailNorm).
+			Where(`? = ?`, pg.Ident(column), value).
+			Where(`deleted IS NULL`).
+			Returning("id, email_verified").
+			Update()
+		if err != nil {
+			return err
+		}
+		rows = result.RowsAffected()
+		if rows != 1 {
+			return nil
+		}
+		err = saveTechnologies(ctx, tx, u)
+		if err != nil {
+			return err
+		}
+		return recordChange(ctx, tx, u.ID, UserModified)
+	})
+	if err != nil {
+		if pgErrCode(err) == "23505" {
+			err = ErrConflict{wraperr{err}}
+			return fmt.Errorf("modifying user: %w", err)
+		}
+		if pgErrCode(err) == "23503" {
+			err = ErrInvalid{wraperr{err}}
+			return fmt.Errorf("modifying user: %w", err)
+		}
+		logf(ctx, "%s: %#v", op, err)
 		return fmt.Errorf("modifying user: %w", err)
 	}
 
-	rows := result.RowsAffected()
 	switch rows {
 	case 0:
-		return ErrNotFound{wraperr{fmt.Errorf("user not found: %s", *u.Email)}}
+		return ErrNotFound{wraperr{fmt.Errorf("user not found: %s", value)}}
 	case 1:
 		// ok
 		return nil
 	default:
-		log.Printf("CRIT: multiple rows affected in ModifyUser(email=%q): %d", *u.Email, rows)
+		logf(ctx, "CRIT: multiple rows affected in %s(%s=%q): %d", op, column, value, rows)
 		return nil
 	}
 }
 
-func (db *PostgresDB) DeleteUser(email string) error {
+func (db *PostgresDB) DeleteUser(ctx context.Context, email string) error {
+	return db.deleteUser(ctx, "DeleteUser", "email_norm", emailLookupKey(email))
+}
+
+func (db *PostgresDB) DeleteUserByID(ctx context.Context, id string) error {
+	return db.deleteUser(ctx, "DeleteUserByID", "public_id", id)
+}
+
+func (db *PostgresDB) deleteUser(ctx context.Context, op, column, value string) error {
 	// TODO: [LATER] consider using pg's "soft_delete" annotation & support
-	result, err := db.pg.Model((*User)(nil)).
-		Set(`deleted = ?`, time.Now()).
-		Where(`email = ?`, email).
-		Where(`deleted IS NULL`).
-		Update()
+	var rows int
+	err := db.inTx(ctx, func(tx orm.DB) error {
+		var ids []int64
+		result, err := tx.ModelContext(ctx, (*User)(nil)).
+			Set(`deleted = ?`, time.Now()).
+			Where(`? = ?`, pg.Ident(column), value).
+			Where(`deleted IS NULL`).
+			Returning("id").
+			Update(&ids)
+		if err != nil {
+			return err
+		}
+		rows = result.RowsAffected()
+		for _, id := range ids {
+			err = recordChange(ctx, tx, id, UserDeleted)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		log.Printf("DeleteUser: %T %#v", err, err)
+		logf(ctx, "%s: %T %#v", op, err, err)
 		return fmt.Errorf("deleting user: %w", err)
 	}
 
-	rows := result.RowsAffected()
 	switch rows {
 	case 0:
-		return ErrNotFound{wraperr{fmt.Errorf("user not found: %s", email)}}
+		return ErrNotFound{wraperr{fmt.Errorf("user not found: %s", value)}}
 	case 1:
 		// ok
 		return nil
 	default:
-		log.Printf("CRIT: multiple rows affected in DeleteUser(email=%q): %d", email, rows)
+		logf(ctx, "CRIT: multiple rows affected in %s(%s=%q): %d", op, column, value, rows)
+		return nil
+	}
+}
+
+// RestoreUserByID undeletes the user with the specified PublicID. It fails
+// with ErrConflict if another active user has the same email.
+func (db *PostgresDB) RestoreUserByID(ctx context.Context, id string) error {
+	var rows int
+	err := db.inTx(ctx, func(tx orm.DB) error {
+		var ids []int64
+		result, err := tx.ModelContext(ctx, (*User)(nil)).
+			Set(`deleted = NULL`).
+			Where(`public_id = ?`, id).
+			Where(`deleted IS NOT NULL`).
+			Returning("id").
+			Update(&ids)
+		if err != nil {
+			return err
+		}
+		rows = result.RowsAffected()
+		for _, id := range ids {
+			err = recordChange(ctx, tx, id, UserRestored)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if pgErrCode(err) == "23505" {
+			err = ErrConflict{wraperr{err}}
+			return fmt.Errorf("restoring user: %w", err)
+		}
+		logf(ctx, "RestoreUserByID: %#v", err)
+		return fmt.Errorf("restoring user: %w", err)
+	}
+	if rows == 0 {
+		return ErrNotFound{wraperr{fmt.Errorf("deleted user not found: %s", id)}}
+	}
+	return nil
+}
+
+// VerifyUserEmail marks the email of the active user with the specified
+// PublicID as verified, if it is still the one with specified normalized
+// form and not verified yet. Otherwise, ErrNotFound is returned.
+func (db *PostgresDB) VerifyUserEmail(ctx context.Context, id, emailNorm string) error {
+	var rows int
+	err := db.inTx(ctx, func(tx orm.DB) error {
+		var ids []int64
+		result, err := tx.ModelContext(ctx, (*User)(nil)).
+			Set(`email_verified = now()`).
+			Where(`public_id = ?`, id).
+			Where(`email_norm = ?`, emailNorm).
+			Where(`deleted IS NULL`).
+			Where(`email_verified IS NULL`).
+			Returning("id").
+			Update(&ids)
+		if err != nil {
+			return err
+		}
+		rows = result.RowsAffected()
+		for _, id := range ids {
+			err = recordChange(ctx, tx, id, UserModified)
+			if err != nil {
+				return err
+			}
+		}
 		return nil
+	})
+	if err != nil {
+		logf(ctx, "VerifyUserEmail: %#v", err)
+		return fmt.Errorf("verifying user email: %w", err)
+	}
+	if rows == 0 {
+		return ErrNotFound{wraperr{fmt.Errorf("unverified user not found: %s", id)}}
 	}
+	return nil
 }
 
 // pgErrCode checks if err is a Postgres error type defined by pg package (i.e.
@@ -190,12 +691,175 @@ func pgErrCode(err error) string {
 	return pgErr.Field('C')
 }
 
-type pgLogger struct{}
+// logf prints a log line, prefixed with tracing & request ID information
+// found in ctx, if any.
+func logf(ctx context.Context, format string, args ...interface{}) {
+	prefix := ""
+	if id := RequestIDFromContext(ctx); id != "" {
+		prefix += "request_id=" + id + " "
+	}
+	if id := traceIDFromContext(ctx); id != "" {
+		prefix += "trace_id=" + id + " "
+	}
+	log.Printf(prefix+format, args...)
+}
+
+// conn returns a handle for querying the database. If ctx contains a request
+// ID, all queries sent via the handle are prefixed with an SQL comment
+// containing it, to allow correlating the queries in Postgres logs and
+// pg_stat_activity with HTTP requests.
+func (db *PostgresDB) conn(ctx context.Context) orm.DB {
+	return withRequestComment(ctx, db.pg)
+}
+
+// inTx runs fn in a transaction, which is committed if fn returns nil, and
+// rolled back otherwise. Queries run via tx are commented like in conn.
+func (db *PostgresDB) inTx(ctx context.Context, fn func(tx orm.DB) error) error {
+	return db.pg.RunInTransaction(func(tx *pg.Tx) error {
+		return fn(withRequestComment(ctx, tx))
+	})
+}
+
+func withRequestComment(ctx context.Context, conn orm.DB) orm.DB {
+	id := RequestIDFromContext(ctx)
+	if id == "" {
+		return conn
+	}
+	// Note: request IDs are validated to not contain characters like '*', '/'
+	// or '?', so they won't break out of the comment, nor be treated as
+	// query placeholders.
+	return commentingDB{DB: conn, comment: "/* request_id=" + id + " */ "}
+}
 
-func (pgLogger) BeforeQuery(ctx context.Context, _ *pg.QueryEvent) (context.Context, error) {
+// commentingDB is an orm.DB prefixing all queries with an SQL comment.
+type commentingDB struct {
+	orm.DB
+	comment string
+}
+
+func (db commentingDB) Model(model ...interface{}) *orm.Query {
+	return orm.NewQuery(db, model...)
+}
+func (db commentingDB) ModelContext(c context.Context, model ...interface{}) *orm.Query {
+	return orm.NewQueryContext(c, db, model...)
+}
+func (db commentingDB) Exec(query interface{}, params ...interface{}) (pg.Result, error) {
+	return db.DB.Exec(db.commented(query), params...)
+}
+func (db commentingDB) ExecContext(c context.Context, query interface{}, params ...interface{}) (pg.Result, error) {
+	return db.DB.ExecContext(c, db.commented(query), params...)
+}
+func (db commentingDB) ExecOne(query interface{}, params ...interface{}) (pg.Result, error) {
+	return db.DB.ExecOne(db.commented(query), params...)
+}
+func (db commentingDB) ExecOneContext(c context.Context, query interface{}, params ...interface{}) (pg.Result, error) {
+	return db.DB.ExecOneContext(c, db.commented(query), params...)
+}
+func (db commentingDB) Query(model, query interface{}, params ...interface{}) (pg.Result, error) {
+	return db.DB.Query(model, db.commented(query), params...)
+}
+func (db commentingDB) QueryContext(c context.Context, model, query interface{}, params ...interface{}) (pg.Result, error) {
+	return db.DB.QueryContext(c, model, db.commented(query), params...)
+}
+func (db commentingDB) QueryOne(model, query interface{}, params ...interface{}) (pg.Result, error) {
+	return db.DB.QueryOne(model, db.commented(query), params...)
+}
+func (db commentingDB) QueryOneContext(c context.Context, model, query interface{}, params ...interface{}) (pg.Result, error) {
+	return db.DB.QueryOneContext(c, model, db.commented(query), params...)
+}
+
+func (db commentingDB) commented(query interface{}) interface{} {
+	switch q := query.(type) {
+	case string:
+		return db.comment + q
+	case interface{ Query() *orm.Query }:
+		// Note: go-pg's formatter requires the query to expose its TableModel
+		model := q.Query().TableModel()
+		if model == nil {
+			return query
+		}
+		return commentedQuery{TableModel: model, comment: db.comment, query: query.(orm.QueryAppender)}
+	default:
+		return query
+	}
+}
+
+// commentedQuery wraps an ORM query, prefixing it with an SQL comment.
+type commentedQuery struct {
+	orm.TableModel
+	comment string
+	query   orm.QueryAppender
+}
+
+func (q commentedQuery) AppendQuery(fmter orm.QueryFormatter, b []byte) ([]byte, error) {
+	return q.query.AppendQuery(fmter, append(b, q.comment...))
+}
+
+func (q commentedQuery) AppendTemplate(b []byte) ([]byte, error) {
+	t, ok := q.query.(orm.TemplateAppender)
+	if !ok {
+		return nil, fmt.Errorf("cannot append template of %T", q.query)
+	}
+	return t.AppendTemplate(append(b, q.comment...))
+}
+
+// pgQueryHook records a tracing span for every SQL query, and logs the
+// queries as configured.
+type pgQueryHook struct {
+	log QueryLog
+}
+
+func (pgQueryHook) BeforeQuery(ctx context.Context, _ *pg.QueryEvent) (context.Context, error) {
+	// Note: outside of traces started by Tracer, the current span is a no-op
+	// one, and so are its children
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(instrumentationName)
+	ctx, _ = tracer.Start(ctx, "db.query", trace.WithSpanKind(trace.SpanKindClient))
 	return ctx, nil
 }
-func (pgLogger) AfterQuery(_ context.Context, q *pg.QueryEvent) error {
-	log.Println(q.FormattedQuery())
+
+func (h pgQueryHook) AfterQuery(ctx context.Context, q *pg.QueryEvent) error {
+	duration := time.Since(q.StartTime)
+	rows := -1
+	if q.Result != nil {
+		rows = q.Result.RowsAffected()
+	}
+
+	span := trace.SpanFromContext(ctx)
+	// Note: unformatted query is used in spans, to avoid exporting user data
+	if query, err := q.UnformattedQuery(); err == nil {
+		span.SetAttributes(attribute.String("db.statement", query))
+	}
+	span.SetAttributes(attribute.String("db.system", "postgresql"))
+	if rows >= 0 {
+		span.SetAttributes(attribute.Int("db.rows_affected", rows))
+	}
+	if q.Err != nil {
+		span.SetStatus(codes.Error, q.Err.Error())
+	}
+	span.End()
+
+	slow := duration >= h.log.SlowThreshold
+	switch {
+	case h.log.Mode == QueryLogAll:
+	case h.log.Mode == QueryLogSlow && slow:
+	default:
+		return nil
+	}
+
+	query, err := q.FormattedQuery()
+	if err != nil {
+		query = fmt.Sprintf("<cannot format query: %s>", err)
+	} else {
+		query = redactSQL(query, sensitiveColumns)
+	}
+	prefix := "sql"
+	if slow && h.log.SlowThreshold > 0 {
+		prefix = "SLOW sql"
+	}
+	if q.Err != nil {
+		logf(ctx, "%s duration=%s rows=%d error=%q: %s", prefix, duration.Round(time.Microsecond), rows, q.Err, query)
+	} else {
+		logf(ctx, "%s duration=%s rows=%d: %s", prefix, duration.Round(time.Microsecond), rows, query)
+	}
 	return nil
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+)
+
+func TestPostgresConfig_Apply(t *testing.T) {
+	tests := []struct {
+		comment   string
+		url       string
+		config    PostgresConfig
+		wantErr   bool
+		wantCheck func(*pg.Options) bool
+	}{
+		{
+			comment:   "empty config keeps URL settings",
+			url:       "postgres://u:p@db:5432/users_db?sslmode=disable",
+			wantCheck: func(o *pg.Options) bool { return o.TLSConfig == nil && o.PoolSize == 0 && o.OnConnect == nil },
+		},
+		{
+			comment: "pool & timeouts",
+			url:     "postgres://u:p@db:5432/users_db",
+			config: PostgresConfig{
+				PoolSize:    7,
+				IdleTimeout: time.Minute,
+				ReadTimeout: 3 * time.Second,
+			},
+			wantCheck: func(o *pg.Options) bool {
+				return o.PoolSize == 7 && o.IdleTimeout == time.Minute && o.ReadTimeout == 3*time.Second
+			},
+		},
+		{
+			comment:   "statement timeout installs OnConnect hook",
+			url:       "postgres://u:p@db:5432/users_db",
+			config:    PostgresConfig{StatementTimeout: 5 * time.Second},
+			wantCheck: func(o *pg.Options) bool { return o.OnConnect != nil },
+		},
+		{
+			comment:   "sslmode override: disable",
+			url:       "postgres://u:p@db:5432/users_db?sslmode=require",
+			config:    PostgresConfig{SSLMode: "disable"},
+			wantCheck: func(o *pg.Options) bool { return o.TLSConfig == nil },
+		},
+		{
+			comment: "sslmode override: verify-full sets server name",
+			url:     "postgres://u:p@db:5432/users_db?sslmode=disable",
+			config:  PostgresConfig{SSLMode: "verify-full"},
+			wantCheck: func(o *pg.Options) bool {
+				return o.TLSConfig != nil && !o.TLSConfig.InsecureSkipVerify && o.TLSConfig.ServerName == "db"
+			},
+		},
+		{
+			comment: "verify-full from URL gets server name",
+			url:     "postgres://u:p@db:5432/users_db?sslmode=verify-full",
+			wantCheck: func(o *pg.Options) bool {
+				return o.TLSConfig != nil && o.TLSConfig.ServerName == "db"
+			},
+		},
+		{
+			comment: "sslmode override: verify-ca checks chain manually",
+			url:     "postgres://u:p@db:5432/users_db",
+			config:  PostgresConfig{SSLMode: "verify-ca"},
+			wantCheck: func(o *pg.Options) bool {
+				return o.TLSConfig != nil && o.TLSConfig.VerifyPeerCertificate != nil
+			},
+		},
+		{
+			comment: "invalid sslmode",
+			url:     "postgres://u:p@db:5432/users_db",
+			config:  PostgresConfig{SSLMode: "maybe"},
+			wantErr: true,
+		},
+		{
+			comment: "root cert without verification",
+			url:     "postgres://u:p@db:5432/users_db",
+			config:  PostgresConfig{SSLMode: "require", SSLRootCert: "/some/file.pem"},
+			wantErr: true,
+		},
+		{
+			comment: "missing root cert file",
+			url:     "postgres://u:p@db:5432/users_db",
+			config:  PostgresConfig{SSLMode: "verify-full", SSLRootCert: "/nonexistent/file.pem"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		opt, err := pg.ParseURL(tt.url)
+		if err != nil {
+			t.Fatalf("%q: %s", tt.comment, err)
+		}
+		err = tt.config.Apply(opt)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: want error, got nil", tt.comment)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tt.comment, err)
+			continue
+		}
+		if !tt.wantCheck(opt) {
+			t.Errorf("%q: bad options: %#v", tt.comment, opt)
+		}
+	}
+}
+
+// capturingHook records formatted queries passed to go-pg.
+type capturingHook struct {
+	queries []string
+}
+
+func (h *capturingHook) BeforeQuery(ctx context.Context, q *pg.QueryEvent) (context.Context, error) {
+	query, err := q.FormattedQuery()
+	if err != nil {
+		query = "ERROR: " + err.Error()
+	}
+	h.queries = append(h.queries, query)
+	return ctx, nil
+}
+func (h *capturingHook) AfterQuery(context.Context, *pg.QueryEvent) error { return nil }
+
+func TestPostgresDB_RequestIDComment(t *testing.T) {
+	// Note: queries are only formatted, the database is never reachable
+	pgdb := pg.Connect(&pg.Options{
+		Dialer: func(context.Context, string, string) (net.Conn, error) {
+			return nil, errors.New("no network in tests")
+		},
+	})
+	defer pgdb.Close()
+	hook := &capturingHook{}
+	pgdb.AddQueryHook(hook)
+	db := &PostgresDB{pg: pgdb}
+
+	ctx := WithRequestID(context.Background(), "abc-123")
+	db.Ping(ctx)
+	db.GetUser(ctx, "john@smith.com")
+	db.CreateUser(ctx, &User{Email: newString("john@smith.com")})
+	db.ModifyUser(ctx, &User{Email: newString("john@smith.com")})
+	db.DeleteUser(ctx, "john@smith.com")
+	db.GetUserAsOf(ctx, "john@smith.com", time.Now())
+
+	// CreateUser, ModifyUser and DeleteUser run in transactions, which fail already on
+	// BEGIN without network. Transaction control statements are issued by
+	// go-pg directly and can't be commented.
+	var queries []string
+	for _, q := range hook.queries {
+		if q != "BEGIN" && q != "ROLLBACK" {
+			queries = append(queries, q)
+		}
+	}
+	if len(queries) != 3 {
+		t.Fatalf("want 3 queries, have %d:\n%s", len(queries), strings.Join(hook.queries, "\n"))
+	}
+	for _, q := range queries {
+		if !strings.HasPrefix(q, "/* request_id=abc-123 */ ") || !strings.Contains(q, "john@smith.com") && !strings.Contains(q, "SELECT 1") {
+			t.Errorf("bad query: %s", q)
+		}
+	}
+
+	// No request ID, no comment
+	hook.queries = nil
+	db.GetUser(context.Background(), "john@smith.com")
+	if len(hook.queries) != 1 || strings.Contains(hook.queries[0], "/*") {
+		t.Errorf("unexpected queries: %q", hook.queries)
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	for _, id := range []string{"abc", "0af7651916cd43dd8448eb211c80319c", "a.b-c_d"} {
+		if !validRequestID(id) {
+			t.Errorf("%q: want valid", id)
+		}
+	}
+	for _, id := range []string{"", "*/ DROP TABLE users; /*", "a?b", "a b", strings.Repeat("x", 65)} {
+		if validRequestID(id) {
+			t.Errorf("%q: want invalid", id)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// technologiesChannel is the Postgres NOTIFY channel signalled by a trigger on
+// every change of the technologies table.
+const technologiesChannel = "technologies_changed"
+
+func (db *PostgresDB) ListTechnologies(ctx context.Context) ([]*Technology, error) {
+	var list []*Technology
+	err := db.conn(ctx).ModelContext(ctx, &list).Order("name").Select()
+	if err != nil {
+		return nil, fmt.Errorf("listing technologies: %w", err)
+	}
+	return list, nil
+}
+
+func (db *PostgresDB) CreateTechnology(ctx context.Context, t *Technology) error {
+	_, err := db.conn(ctx).ModelContext(ctx, t).Insert()
+	if err != nil {
+		if pgErrCode(err) == "23505" {
+			err = ErrConflict{wraperr{err}}
+		}
+		return fmt.Errorf("creating technology: %w", err)
+	}
+	return nil
+}
+
+func (db *PostgresDB) ModifyTechnology(ctx context.Context, t *Technology) error {
+	result, err := db.conn(ctx).ModelContext(ctx, t).WherePK().Update()
+	if err != nil {
+		return fmt.Errorf("modifying technology: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound{wraperr{fmt.Errorf("technology not found: %s", t.Name)}}
+	}
+	return nil
+}
+
+// DeleteTechnology removes a technology from the catalog. It fails with
+// ErrConflict if any user (also a deleted one) has the technology assigned.
+func (db *PostgresDB) DeleteTechnology(ctx context.Context, name string) error {
+	result, err := db.conn(ctx).ModelContext(ctx, &Technology{Name: name}).WherePK().Delete()
+	if err != nil {
+		// foreign_key_violation
+		if pgErrCode(err) == "23503" {
+			err = ErrConflict{wraperr{fmt.Errorf("technology is assigned to users: %s", name)}}
+		}
+		return fmt.Errorf("deleting technology: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound{wraperr{fmt.Errorf("technology not found: %s", name)}}
+	}
+	return nil
+}
+
+// WatchTechnologies loads the technologies from the database into catalog,
+// and starts a goroutine reloading them whenever they change (as notified by
+// Postgres), and additionally every refreshEvery, in case a notification was
+// lost while reconnecting. The goroutine stops when db is closed.
+func (db *PostgresDB) WatchTechnologies(catalog *TechnologyCatalog, refreshEvery time.Duration) error {
+	reload := func() error {
+		list, err := db.ListTechnologies(context.Background())
+		if err != nil {
+			return err
+		}
+		names := make([]string, len(list))
+		for i, t := range list {
+			names[i] = t.Name
+		}
+		catalog.Set(names)
+		return nil
+	}
+	// Start listening before the initial load, to not miss any changes
+	ln := db.pg.Listen(technologiesChannel)
+	err := reload()
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	db.background.Add(1)
+	go func() {
+		defer db.background.Done()
+		defer ln.Close()
+		notifications := ln.Channel()
+		ticker := time.NewTicker(refreshEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.closing:
+				return
+			case <-notifications:
+			case <-ticker.C:
+			}
+			err := reload()
+			if err != nil {
+				log.Printf("ERROR: reloading technologies: %s", err)
+			}
+		}
+	}()
+	return nil
+}
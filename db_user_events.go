@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	"github.com/go-pg/pg/v9/orm"
+)
+
+// userEventsChannel is the Postgres NOTIFY channel signalled by a trigger on
+// every insert into the user_events table.
+const userEventsChannel = "user_events_inserted"
+
+// userEventsPendingChannel is the Postgres NOTIFY channel signalled by a
+// trigger on every insert into the user_events_pending table.
+const userEventsPendingChannel = "user_events_pending_inserted"
+
+// userEventsLock is the key of the Postgres advisory lock serializing
+// sequencers of user events (see sequenceUserEvents), so that event IDs are
+// committed in increasing order, and readers resuming after an ID never skip
+// an event committed later with a lower ID. Transactions recording events
+// don't take it, so they are not serialized.
+const userEventsLock = 0x75736572 // "user"
+
+// pendingUserEvent is a UserEvent recorded, but not yet assigned an ID (see
+// sequenceUserEvents). Seq orders pending events by the time they were
+// recorded.
+type pendingUserEvent struct {
+	tableName struct{} `pg:"user_events_pending"`
+
+	Seq    int64
+	Type   string
+	UserID string    `pg:",type:uuid"`
+	Time   time.Time `pg:"default:now()"`
+	User   *User     `pg:"data"`
+}
+
+// recordChange stores the current state of the user with the specified ID as
+// a new version (see recordVersion), and records an event of the specified
+// type, which is published once a sequencer assigns it an ID (see
+// SequenceUserEvents). It must be called in the transaction which modified
+// the user.
+func recordChange(ctx context.Context, tx orm.DB, id int64, eventType string) error {
+	err := recordVersion(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	// The version just recorded holds both the user and its technologies
+	v := &userVersion{}
+	err = tx.ModelContext(ctx, v).
+		Where(`id = ?`, id).
+		Where(`valid_to IS NULL`).
+		Select()
+	if err != nil {
+		return fmt.Errorf("recording user event: %w", err)
+	}
+	u := v.user()
+	u.Password = nil
+
+	e := &pendingUserEvent{
+		Type:   eventType,
+		UserID: u.PublicID,
+		User:   u,
+	}
+	_, err = tx.ModelContext(ctx, e).Insert()
+	if err != nil {
+		return fmt.Errorf("recording user event: %w", err)
+	}
+	return nil
+}
+
+// SequenceUserEvents starts a goroutine moving recorded user events to the
+// feed of events (see sequenceUserEvents), whenever Postgres notifies about
+// new ones, and additionally every pollEvery. At least one process using the
+// database must run it; running it in more processes is safe. The goroutine
+// stops when db is closed.
+func (db *PostgresDB) SequenceUserEvents(pollEvery time.Duration) {
+	ln := db.pg.Listen(userEventsPendingChannel)
+	db.background.Add(1)
+	go func() {
+		defer db.background.Done()
+		defer ln.Close()
+		notifications := ln.Channel()
+		ticker := time.NewTicker(pollEvery)
+		defer ticker.Stop()
+		for {
+			for {
+				moved, err := db.sequenceUserEvents()
+				if err != nil {
+					log.Printf("ERROR: sequencing user events: %s", err)
+				}
+				if moved == 0 || err != nil {
+					break
+				}
+			}
+			select {
+			case <-db.closing:
+				return
+			case <-notifications:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// sequenceUserEvents moves a batch of pending events to user_events,
+// assigning them IDs following the highest one already there, in order of
+// recording, and queues their delivery to webhooks. It returns the number of
+// events moved.
+//
+// Only the sequencers are serialized (with userEventsLock), instead of all
+// transactions recording events, so events are ordered by commit without
+// limiting the throughput of writes. Two events of the same user are always
+// moved in order, as transactions modifying the user are serialized by its
+// row lock.
+func (db *PostgresDB) sequenceUserEvents() (int, error) {
+	const batchSize = 1000
+	var moved int
+	err := db.pg.RunInTransaction(func(tx *pg.Tx) error {
+		_, err := tx.Exec(`SELECT pg_advisory_xact_lock(?)`, userEventsLock)
+		if err != nil {
+			return err
+		}
+		// Note: the lock is taken before any snapshot is used, so all
+		// events moved by previous sequencers are visible below
+		var lastID int64
+		_, err = tx.QueryOne(pg.Scan(&lastID), `SELECT coalesce(max(id), 0) FROM user_events`)
+		if err != nil {
+			return err
+		}
+		result, err := tx.Exec(`
+			WITH moved AS (
+				DELETE FROM user_events_pending
+				WHERE seq IN (SELECT seq FROM user_events_pending ORDER BY seq LIMIT ?0)
+				RETURNING seq, type, user_id, time, data
+			)
+			INSERT INTO user_events (id, type, user_id, time, data)
+			SELECT ?1 + row_number() OVER (ORDER BY seq), type, user_id, time, data
+			FROM moved`, batchSize, lastID)
+		if err != nil {
+			return err
+		}
+		moved = result.RowsAffected()
+		if moved == 0 {
+			return nil
+		}
+		return queueWebhookDeliveries(context.Background(), tx, lastID)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return moved, nil
+}
+
+// ListUserEvents returns up to limit events with IDs greater than after, in
+// order of IDs.
+func (db *PostgresDB) ListUserEvents(ctx context.Context, after int64, limit int) ([]*UserEvent, error) {
+	var events []*UserEvent
+	err := db.conn(ctx).ModelContext(ctx, &events).
+		Where(`id > ?`, after).
+		Order("id").
+		Limit(limit).
+		Select()
+	if err != nil {
+		return nil, fmt.Errorf("listing user events: %w", err)
+	}
+	return events, nil
+}
+
+// WatchUserEvents starts a goroutine calling n.Notify whenever new user events
+// are recorded (as notified by Postgres). The goroutine stops when db is
+// closed.
+func (db *PostgresDB) WatchUserEvents(n *EventNotifier) {
+	ln := db.pg.Listen(userEventsChannel)
+	db.background.Add(1)
+	go func() {
+		defer db.background.Done()
+		defer ln.Close()
+		notifications := ln.Channel()
+		for {
+			select {
+			case <-db.closing:
+				return
+			case <-notifications:
+				n.Notify()
+			}
+		}
+	}()
+}
+
+// RelayUserEvents starts a goroutine passing all user events to p, in order.
+// The ID of the last event accepted by p is stored in the database under the
+// specified consumer name, so that after a restart, relaying resumes from
+// the next event. New events are checked for when n is notified, and
+// additionally every pollEvery. Delivery is at least once: if multiple
+// processes relay events for the same consumer, a batch may be published by
+// more than one of them, though the stored ID only moves forward. The
+// goroutine stops when db is closed.
+func (db *PostgresDB) RelayUserEvents(consumer string, p EventPublisher, n *EventNotifier, pollEvery time.Duration) error {
+	_, err := db.pg.Exec(`
+		INSERT INTO user_event_offsets (consumer) VALUES (?)
+		ON CONFLICT DO NOTHING`, consumer)
+	if err != nil {
+		return fmt.Errorf("registering user events consumer: %w", err)
+	}
+
+	db.background.Add(1)
+	go func() {
+		defer db.background.Done()
+		ticker := time.NewTicker(pollEvery)
+		defer ticker.Stop()
+		for {
+			notified := n.Wait()
+			for {
+				relayed, err := db.relayUserEvents(consumer, p)
+				if err != nil {
+					log.Printf("ERROR: relaying user events to %s: %s", consumer, err)
+				}
+				if relayed == 0 || err != nil {
+					break
+				}
+			}
+			select {
+			case <-db.closing:
+				return
+			case <-notified:
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// relayUserEvents passes the next batch of events to p, and returns the number
+// of events passed. The consumer's offset is only locked while the batch is
+// read, so that no database connection is held while p is publishing; it is
+// then advanced only if no concurrent relay has advanced it meanwhile.
+func (db *PostgresDB) relayUserEvents(consumer string, p EventPublisher) (int, error) {
+	const (
+		batchSize      = 100
+		publishTimeout = 30 * time.Second
+	)
+	var (
+		lastID int64
+		events []*UserEvent
+	)
+	err := db.pg.RunInTransaction(func(tx *pg.Tx) error {
+		_, err := tx.QueryOne(pg.Scan(&lastID), `
+			SELECT last_id FROM user_event_offsets
+			WHERE consumer = ?
+			FOR UPDATE SKIP LOCKED`, consumer)
+		if err == pg.ErrNoRows {
+			// Another process is reading events for consumer
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Model(&events).
+			Where(`id > ?`, lastID).
+			Order("id").
+			Limit(batchSize).
+			Select()
+	})
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	err = p.Publish(ctx, events)
+	if err != nil {
+		return 0, fmt.Errorf("publishing: %w", err)
+	}
+	result, err := db.pg.Exec(`
+		UPDATE user_event_offsets SET last_id = ?
+		WHERE consumer = ? AND last_id = ?`, events[len(events)-1].ID, consumer, lastID)
+	if err != nil {
+		return 0, err
+	}
+	if result.RowsAffected() == 0 {
+		// Another process relayed the events meanwhile
+		return 0, nil
+	}
+	return len(events), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	"github.com/go-pg/pg/v9/orm"
+)
+
+// userVersion is the state of a User in the period between ValidFrom and
+// ValidTo (exclusive). The current version has a nil ValidTo.
+type userVersion struct {
+	tableName struct{} `pg:"user_versions,alias:user"`
+
+	User
+	ValidFrom time.Time
+	ValidTo   *time.Time
+	// VersionTechnologies is a copy of User.Technologies, which are stored
+	// in a separate table for current versions.
+	VersionTechnologies []UserTechnology `pg:"technologies"`
+}
+
+// userColumns lists all columns of the users table, which are copied to
+// user_versions.
+var userColumns = func() pg.Safe {
+	var columns []string
+	for _, f := range orm.GetTable(reflect.TypeOf(User{})).Fields {
+		columns = append(columns, string(f.Column))
+	}
+	return pg.Safe(strings.Join(columns, ", "))
+}()
+
+// recordVersion stores the current state of the user with the specified ID
+// as a new version, ending the previous one. It must be called in the
+// transaction which modified the user.
+func recordVersion(ctx context.Context, tx orm.DB, id int64) error {
+	technologies := []UserTechnology{}
+	err := tx.ModelContext(ctx, &technologies).
+		Where(`user_id = ?`, id).
+		Order("level DESC", "technology").
+		Select()
+	if err != nil {
+		return fmt.Errorf("recording user version: %w", err)
+	}
+	// Note: now() is the same for all statements in a transaction
+	_, err = tx.ExecContext(ctx, `
+		UPDATE user_versions SET valid_to = now() WHERE id = ? AND valid_to IS NULL`, id)
+	if err != nil {
+		return fmt.Errorf("recording user version: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO user_versions (?0, valid_from, technologies)
+		SELECT ?0, now(), ?1 FROM users WHERE id = ?2`, userColumns, technologies, id)
+	if err != nil {
+		return fmt.Errorf("recording user version: %w", err)
+	}
+	return nil
+}
+
+// GetUserAsOf returns the user which was active with the specified email at
+// the specified time, also if it was modified or deleted since then.
+func (db *PostgresDB) GetUserAsOf(ctx context.Context, email string, at time.Time) (*User, error) {
+	var versions []*userVersion
+	err := db.conn(ctx).ModelContext(ctx, &versions).
+		Where(`email_norm = ?`, emailLookupKey(email)).
+		Where(`deleted IS NULL`).
+		Where(`valid_from <= ?`, at).
+		Where(`valid_to IS NULL OR valid_to > ?`, at).
+		Select()
+	if err != nil {
+		logf(ctx, "GetUserAsOf: %#v", err)
+		return nil, fmt.Errorf("getting user version: %w", err)
+	}
+
+	switch len(versions) {
+	case 0:
+		return nil, nil
+	case 1:
+		return versions[0].user(), nil
+	default:
+		logf(ctx, "CRIT: multiple rows returned in GetUserAsOf(%q, %s): %d", email, at, len(versions))
+		return nil, fmt.Errorf("Internal Server Error")
+	}
+}
+
+func (v *userVersion) user() *User {
+	u := v.User
+	u.Technologies = v.VersionTechnologies
+	return &u
+}
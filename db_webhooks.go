@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	"github.com/go-pg/pg/v9/orm"
+)
+
+func (db *PostgresDB) ListWebhooks(ctx context.Context) ([]*Webhook, error) {
+	var list []*Webhook
+	err := db.conn(ctx).ModelContext(ctx, &list).Order("created", "id").Select()
+	if err != nil {
+		return nil, fmt.Errorf("listing webhooks: %w", err)
+	}
+	return list, nil
+}
+
+func (db *PostgresDB) GetWebhook(ctx context.Context, id string) (*Webhook, error) {
+	h := &Webhook{ID: id}
+	err := db.conn(ctx).ModelContext(ctx, h).WherePK().Select()
+	if err == pg.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting webhook: %w", err)
+	}
+	return h, nil
+}
+
+// CreateWebhook inserts h into the database, assigning it a new ID. Only
+// events recorded afterwards are delivered to it.
+func (db *PostgresDB) CreateWebhook(ctx context.Context, h *Webhook) error {
+	h.ID = newPublicID()
+	_, err := db.conn(ctx).ModelContext(ctx, h).Insert()
+	if err != nil {
+		return fmt.Errorf("creating webhook: %w", err)
+	}
+	return nil
+}
+
+// ModifyWebhook updates the URL and event types of a webhook, and also its
+// secret, unless h.Secret is empty.
+func (db *PostgresDB) ModifyWebhook(ctx context.Context, h *Webhook) error {
+	excluded := []string{"created"}
+	if h.Secret == "" {
+		excluded = append(excluded, "secret")
+	}
+	result, err := db.conn(ctx).ModelContext(ctx, h).
+		ExcludeColumn(excluded...).
+		WherePK().
+		Update()
+	if err != nil {
+		return fmt.Errorf("modifying webhook: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound{wraperr{fmt.Errorf("webhook not found: %s", h.ID)}}
+	}
+	return nil
+}
+
+// DeleteWebhook removes a webhook together with its deliveries.
+func (db *PostgresDB) DeleteWebhook(ctx context.Context, id string) error {
+	result, err := db.conn(ctx).ModelContext(ctx, &Webhook{ID: id}).WherePK().Delete()
+	if err != nil {
+		return fmt.Errorf("deleting webhook: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound{wraperr{fmt.Errorf("webhook not found: %s", id)}}
+	}
+	return nil
+}
+
+// ListWebhookDeliveries returns the latest deliveries of a webhook, newest
+// first. If state is not empty, only deliveries in that state are returned.
+func (db *PostgresDB) ListWebhookDeliveries(ctx context.Context, webhookID, state string) ([]*WebhookDelivery, error) {
+	const limit = 100
+	var list []*WebhookDelivery
+	query := db.conn(ctx).ModelContext(ctx, &list).
+		Where(`webhook_id = ?`, webhookID).
+		Order("id DESC").
+		Limit(limit)
+	if state != "" {
+		query = query.Where(`state = ?`, state)
+	}
+	err := query.Select()
+	if err != nil {
+		return nil, fmt.Errorf("listing webhook deliveries: %w", err)
+	}
+	return list, nil
+}
+
+// RetryWebhookDelivery puts a dead delivery back into the queue, with a
+// fresh count of attempts.
+func (db *PostgresDB) RetryWebhookDelivery(ctx context.Context, webhookID string, id int64) error {
+	result, err := db.conn(ctx).ModelContext(ctx, (*WebhookDelivery)(nil)).
+		Set(`state = ?`, DeliveryPending).
+		Set(`attempts = 0`).
+		Set(`next_attempt = now()`).
+		Where(`id = ?`, id).
+		Where(`webhook_id = ?`, webhookID).
+		Where(`state = ?`, DeliveryDead).
+		Update()
+	if err != nil {
+		return fmt.Errorf("retrying webhook delivery: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound{wraperr{fmt.Errorf("dead delivery %d not found in webhook %s", id, webhookID)}}
+	}
+	return nil
+}
+
+// queueWebhookDeliveries queues delivery of all events with IDs greater than
+// afterID to all webhooks interested in them. It must be called in the
+// transaction which added the events to user_events (see
+// sequenceUserEvents).
+func queueWebhookDeliveries(ctx context.Context, tx orm.DB, afterID int64) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries (webhook_id, event_id)
+		SELECT w.id, e.id FROM user_events AS e
+		JOIN webhooks AS w ON w.event_types = '{}' OR e.type = ANY (w.event_types)
+		WHERE e.id > ?
+		ORDER BY e.id, w.id`, afterID)
+	if err != nil {
+		return fmt.Errorf("queueing webhook deliveries: %w", err)
+	}
+	return nil
+}
+
+// DeliverWebhooks starts a goroutine sending queued webhook deliveries with
+// s. Deliveries are checked for when n is notified about new events, and
+// additionally every pollEvery, which is also the resolution of retry
+// delays. Failed deliveries are retried with exponential backoff (see
+// webhookBackoff), until they become dead. Multiple processes can deliver
+// from the same queue. The goroutine stops when db is closed.
+func (db *PostgresDB) DeliverWebhooks(s *WebhookSender, n *EventNotifier, pollEvery time.Duration) {
+	db.background.Add(1)
+	go func() {
+		defer db.background.Done()
+		ticker := time.NewTicker(pollEvery)
+		defer ticker.Stop()
+		for {
+			notified := n.Wait()
+			for {
+				sent, err := db.deliverWebhooks(s)
+				if err != nil {
+					log.Printf("ERROR: delivering webhooks: %s", err)
+				}
+				if sent == 0 || err != nil {
+					break
+				}
+				select {
+				case <-db.closing:
+					return
+				default:
+				}
+			}
+			select {
+			case <-db.closing:
+				return
+			case <-notified:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// deliverWebhooks sends a batch of due deliveries, and returns the number of
+// deliveries attempted. If any attempt could not be recorded, the first such
+// error is returned after the whole batch is processed.
+func (db *PostgresDB) deliverWebhooks(s *WebhookSender) (int, error) {
+	const batchSize = 10
+	// Claim the deliveries by moving their next attempt past the time
+	// needed to send them, so that other processes don't pick them up.
+	// If this process dies meanwhile, they will be retried afterwards.
+	lease := batchSize * (s.timeout() + time.Second)
+	var deliveries []*WebhookDelivery
+	_, err := db.pg.Query(&deliveries, `
+		UPDATE webhook_deliveries SET next_attempt = now() + ?0 * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE state = ?1 AND next_attempt <= now()
+			ORDER BY next_attempt
+			LIMIT ?2
+			FOR UPDATE SKIP LOCKED)
+		RETURNING *`, lease.Seconds(), DeliveryPending, batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("claiming deliveries: %w", err)
+	}
+
+	// Note: failures of single deliveries are recorded on them, so that
+	// the rest of the batch is not delayed until the lease expires
+	var recordErr error
+	for _, d := range deliveries {
+		h := &Webhook{ID: d.WebhookID}
+		err := db.pg.Model(h).WherePK().Select()
+		if err == pg.ErrNoRows {
+			// Deleted meanwhile, together with the delivery
+			continue
+		}
+		var status int
+		if err != nil {
+			err = fmt.Errorf("loading webhook: %w", err)
+		} else {
+			status, err = db.sendWebhookDelivery(s, h, d)
+		}
+
+		d.Attempts++
+		d.LastStatus = status
+		d.LastError = ""
+		now := time.Now()
+		d.LastAttempt = &now
+		switch {
+		case err == nil:
+			d.State = DeliveryDelivered
+			d.NextAttempt = nil
+		case d.Attempts >= s.maxAttempts():
+			d.State = DeliveryDead
+			d.NextAttempt = nil
+			d.LastError = err.Error()
+		default:
+			next := now.Add(webhookBackoff(d.Attempts))
+			d.NextAttempt = &next
+			d.LastError = err.Error()
+		}
+		if len(d.LastError) > 1000 {
+			d.LastError = d.LastError[:1000]
+		}
+		_, err = db.pg.Model(d).
+			Column("state", "attempts", "next_attempt", "last_attempt", "last_status", "last_error").
+			WherePK().
+			Update()
+		if err != nil && recordErr == nil {
+			recordErr = fmt.Errorf("recording delivery %d: %w", d.ID, err)
+		}
+	}
+	return len(deliveries), recordErr
+}
+
+// sendWebhookDelivery loads the event of d and sends it to h with s,
+// returning the HTTP status of the response if one was received.
+func (db *PostgresDB) sendWebhookDelivery(s *WebhookSender, h *Webhook, d *WebhookDelivery) (int, error) {
+	e := &UserEvent{ID: d.EventID}
+	err := db.pg.Model(e).WherePK().Select()
+	if err != nil {
+		return 0, fmt.Errorf("loading event: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout())
+	defer cancel()
+	return s.Send(ctx, h, d.ID, e)
+}
@@ -3,6 +3,10 @@ package main
 type ErrConflict struct{ wraperr }
 type ErrNotFound struct{ wraperr }
 
+// ErrInvalid means that the data was rejected by the database, e.g. because
+// it references a non-existent object.
+type ErrInvalid struct{ wraperr }
+
 // wraperr is a helper type, allowing to easily wrap errors in "tagged" types.
 type wraperr struct{ err error }
 
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Types of UserEvent.
+const (
+	UserCreated  = "user.created"
+	UserModified = "user.modified"
+	UserDeleted  = "user.deleted"
+	UserRestored = "user.restored"
+)
+
+// UserEvent describes a change of a User, for other services interested in
+// the changes (e.g. billing, mailing lists). Events are written to the
+// database in the same transaction as the change (transactional outbox), so
+// no change is missed and no event is published for a rolled back change.
+type UserEvent struct {
+	tableName struct{} `pg:"user_events,alias:event"`
+
+	// ID is the position of the event in the feed of all events. IDs
+	// increase in the order in which the events were committed, so a
+	// client can resume reading the feed after the last ID it processed.
+	ID     int64     `json:"id"`
+	Type   string    `json:"type"`
+	UserID string    `json:"user_id" pg:",type:uuid"`
+	Time   time.Time `json:"time" pg:"default:now()"`
+	// User is the state of the user after the change, without password.
+	User *User `json:"user" pg:"data"`
+}
+
+const (
+	// DefaultUserEventsLimit is the default number of events returned by
+	// a single request to the events feed.
+	DefaultUserEventsLimit = 100
+	// MaxUserEventsLimit is the maximum number of events returned by a
+	// single request to the events feed.
+	MaxUserEventsLimit = 1000
+	// MaxUserEventsWait is the maximum time a long-polling request to the
+	// events feed waits for new events.
+	MaxUserEventsWait = time.Minute
+)
+
+// EventNotifier wakes up goroutines waiting for new events. All its methods
+// can be called on a nil *EventNotifier, in which case waiting never ends
+// early, and waiters must poll.
+type EventNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func NewEventNotifier() *EventNotifier {
+	return &EventNotifier{ch: make(chan struct{})}
+}
+
+// Wait returns a channel which is closed on the next call to Notify.
+func (n *EventNotifier) Wait() <-chan struct{} {
+	if n == nil {
+		return nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ch
+}
+
+// Notify wakes up all current waiters.
+func (n *EventNotifier) Notify() {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
+
+// EventPublisher delivers user events to an external broker, e.g. Kafka or
+// NATS. Events are passed in order of IDs, and delivered at least once: if
+// Publish returns an error, all the events are passed again later, so a
+// broker may receive duplicates, which consumers can detect by the IDs.
+type EventPublisher interface {
+	Publish(ctx context.Context, events []*UserEvent) error
+}
+
+// WriterEventPublisher writes events to a Writer, as one JSON object per
+// line. It is mostly useful for local runs, with os.Stdout, or for shipping
+// events with a log collector.
+type WriterEventPublisher struct {
+	W io.Writer
+
+	mu sync.Mutex
+}
+
+func (p *WriterEventPublisher) Publish(_ context.Context, events []*UserEvent) error {
+	var buf []byte
+	for _, e := range events {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("encoding event %d: %w", e.ID, err)
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.W.Write(buf)
+	return err
+}
+
+// eventsPollInterval is how often the events feed checks for new events if it
+// was not notified about them, in case a notification was lost. It also
+// bounds the time after which streams notice the server is shutting down.
+var eventsPollInterval = 5 * time.Second
+
+// eventsKeepAliveInterval is how often an idle Server-Sent Events stream
+// sends a comment, to keep proxies from closing the connection.
+var eventsKeepAliveInterval = 15 * time.Second
+
+// listUserEvents serves the feed of user events (to admins only, see
+// Server.admin, as events carry personal data), starting after the event
+// with ID provided in the 'after' query parameter (by default, from the
+// beginning). If the request accepts text/event-stream, the events are
+// streamed as Server-Sent Events, and a reconnecting client is resumed after
+// its Last-Event-ID. Otherwise, up to 'limit' events are returned as a JSON
+// array; if there are none, the request waits for up to 'wait' (e.g. "30s")
+// for new ones to arrive (long polling).
+func (s *Server) listUserEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	after, err := parseEventID(query.Get("after"))
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, fmt.Errorf("bad 'after' query parameter: %w", err))
+		return
+	}
+	limit := DefaultUserEventsLimit
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > MaxUserEventsLimit {
+			RespondError(w, http.StatusBadRequest, fmt.Errorf("'limit' query parameter must be a number from 1 to %d", MaxUserEventsLimit))
+			return
+		}
+	}
+	var wait time.Duration
+	if v := query.Get("wait"); v != "" {
+		wait, err = time.ParseDuration(v)
+		if err != nil || wait < 0 || wait > MaxUserEventsWait {
+			RespondError(w, http.StatusBadRequest, fmt.Errorf("'wait' query parameter must be a duration from 0s to %s", MaxUserEventsWait))
+			return
+		}
+	}
+
+	if acceptsEventStream(r) {
+		if id := r.Header.Get("Last-Event-ID"); id != "" {
+			after, err = parseEventID(id)
+			if err != nil {
+				RespondError(w, http.StatusBadRequest, fmt.Errorf("bad Last-Event-ID header: %w", err))
+				return
+			}
+		}
+		s.streamUserEvents(w, r, after, limit)
+		return
+	}
+
+	ctx := r.Context()
+	deadline := time.Now().Add(wait)
+	for {
+		// Get the channel before querying, to not miss a notification
+		// about events committed in the meantime
+		notified := s.Events.Wait()
+		events, err := s.DB.ListUserEvents(ctx, after, limit)
+		if err != nil {
+			RespondError(w, http.StatusInternalServerError, err)
+			return
+		}
+		remaining := time.Until(deadline)
+		if len(events) > 0 || remaining <= 0 || s.isShuttingDown() {
+			if events == nil {
+				events = []*UserEvent{}
+			}
+			RespondJSON(w, http.StatusOK, events)
+			return
+		}
+		if remaining > eventsPollInterval {
+			remaining = eventsPollInterval
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-notified:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// streamUserEvents writes events after the specified ID to w as Server-Sent
+// Events, until the client disconnects or the server shuts down.
+func (s *Server) streamUserEvents(w http.ResponseWriter, r *http.Request, after int64, limit int) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		RespondError(w, http.StatusNotAcceptable, errors.New("streaming is not supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ctx := r.Context()
+	idleSince := time.Now()
+	for !s.isShuttingDown() {
+		notified := s.Events.Wait()
+		events, err := s.DB.ListUserEvents(ctx, after, limit)
+		if err != nil {
+			if ctx.Err() == nil {
+				logf(ctx, "ERROR: streaming user events: %s", err)
+			}
+			return
+		}
+		for _, e := range events {
+			buf, err := json.Marshal(e)
+			if err != nil {
+				logf(ctx, "BUG: encoding user event %d: %s", e.ID, err)
+				return
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, buf)
+			if err != nil {
+				return
+			}
+			after = e.ID
+		}
+		if len(events) > 0 {
+			flusher.Flush()
+			idleSince = time.Now()
+			if len(events) == limit {
+				continue
+			}
+		} else if time.Since(idleSince) >= eventsKeepAliveInterval {
+			_, err = io.WriteString(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+			idleSince = time.Now()
+		}
+
+		timer := time.NewTimer(eventsPollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-notified:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func parseEventID(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 0 {
+		return 0, errors.New("must be a non-negative event ID")
+	}
+	return id, nil
+}
+
+// acceptsEventStream returns true if the Accept header of r lists
+// text/event-stream.
+func acceptsEventStream(r *http.Request) bool {
+	for _, accept := range r.Header["Accept"] {
+		for _, media := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(media)
+			if err == nil && mediaType == "text/event-stream" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Server) isShuttingDown() bool {
+	return atomic.LoadInt32(&s.shuttingDown) != 0
+}
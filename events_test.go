@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestServer_ListUserEvents(t *testing.T) {
+	all := []*UserEvent{
+		{ID: 1, Type: UserCreated, UserID: "u1"},
+		{ID: 2, Type: UserModified, UserID: "u1"},
+		{ID: 3, Type: UserDeleted, UserID: "u1"},
+	}
+	srv := Server{
+		DB: callbackDB{
+			listUserEvents: func(after int64, limit int) ([]*UserEvent, error) {
+				var list []*UserEvent
+				for _, e := range all {
+					if e.ID > after && len(list) < limit {
+						list = append(list, e)
+					}
+				}
+				return list, nil
+			},
+		},
+		AdminToken: "secret",
+	}
+	r := mux.NewRouter()
+	srv.RegisterAt(r)
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantIDs    []int64
+	}{
+		{"", http.StatusOK, []int64{1, 2, 3}},
+		{"?after=1", http.StatusOK, []int64{2, 3}},
+		{"?after=1&limit=1", http.StatusOK, []int64{2}},
+		{"?after=3", http.StatusOK, []int64{}},
+		{"?after=-1", http.StatusBadRequest, nil},
+		{"?after=x", http.StatusBadRequest, nil},
+		{"?limit=0", http.StatusBadRequest, nil},
+		{"?limit=1001", http.StatusBadRequest, nil},
+		{"?wait=2m", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		rq := httptest.NewRequest("GET", "/v1/user-events"+tt.query, nil)
+		rq.Header.Set("Authorization", "Bearer secret")
+		r.ServeHTTP(w, rq)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%q: want status %d, have %d: %s", tt.query, tt.wantStatus, w.Code, w.Body)
+			continue
+		}
+		if tt.wantIDs == nil {
+			continue
+		}
+		var events []*UserEvent
+		err := json.Unmarshal(w.Body.Bytes(), &events)
+		if err != nil {
+			t.Errorf("%q: bad response: %s: %s", tt.query, err, w.Body)
+			continue
+		}
+		ids := []int64{}
+		for _, e := range events {
+			ids = append(ids, e.ID)
+		}
+		if dumpJSON(ids) != dumpJSON(tt.wantIDs) {
+			t.Errorf("%q: want events %v, have %v", tt.query, tt.wantIDs, ids)
+		}
+	}
+
+	// Events contain personal data, so they require the admin token
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/v1/user-events", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("without token: want status %d, have %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestServer_ListUserEvents_LongPoll(t *testing.T) {
+	events := NewEventNotifier()
+	calls := 0
+	srv := Server{
+		DB: callbackDB{
+			listUserEvents: func(after int64, limit int) ([]*UserEvent, error) {
+				calls++
+				if calls == 1 {
+					// A new event gets committed after the query
+					go events.Notify()
+					return nil, nil
+				}
+				return []*UserEvent{{ID: after + 1, Type: UserCreated}}, nil
+			},
+		},
+		Events:     events,
+		AdminToken: "secret",
+	}
+	r := mux.NewRouter()
+	srv.RegisterAt(r)
+
+	w := httptest.NewRecorder()
+	start := time.Now()
+	rq := httptest.NewRequest("GET", "/v1/user-events?after=7&wait=30s", nil)
+	rq.Header.Set("Authorization", "Bearer secret")
+	r.ServeHTTP(w, rq)
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("notification did not wake up the request")
+	}
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"id":8`) {
+		t.Errorf("bad response: %d %s", w.Code, w.Body)
+	}
+	if calls != 2 {
+		t.Errorf("want 2 queries, have %d", calls)
+	}
+}
+
+func TestServer_ListUserEvents_Stream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var afters []int64
+	events := NewEventNotifier()
+	srv := Server{
+		DB: callbackDB{
+			listUserEvents: func(after int64, limit int) ([]*UserEvent, error) {
+				afters = append(afters, after)
+				switch after {
+				case 5:
+					go events.Notify()
+					return []*UserEvent{{ID: 6, Type: UserCreated}, {ID: 7, Type: UserRestored}}, nil
+				default:
+					// Client disconnects
+					cancel()
+					return nil, ctx.Err()
+				}
+			},
+		},
+		Events:     events,
+		AdminToken: "secret",
+	}
+	r := mux.NewRouter()
+	srv.RegisterAt(r)
+
+	w := httptest.NewRecorder()
+	rq := httptest.NewRequest("GET", "/v1/user-events?after=1", nil).WithContext(ctx)
+	rq.Header.Set("Accept", "text/event-stream")
+	rq.Header.Set("Last-Event-ID", "5")
+	rq.Header.Set("Authorization", "Bearer secret")
+	r.ServeHTTP(w, rq)
+
+	if w.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("bad Content-Type: %q", w.Header().Get("Content-Type"))
+	}
+	want := "id: 6\nevent: user.created\ndata: {\"id\":6,"
+	if !strings.HasPrefix(w.Body.String(), want) || !strings.Contains(w.Body.String(), "\n\nid: 7\nevent: user.restored\n") {
+		t.Errorf("bad stream:\n%s", w.Body)
+	}
+	if dumpJSON(afters) != "[5,7]" {
+		t.Errorf("want queries after [5,7], have %v", afters)
+	}
+}
+
+func TestServer_RestoreUserByID(t *testing.T) {
+	const (
+		deletedID  = "7b1a8c3e-2f4d-4e5a-9b6c-0d1e2f3a4b5c"
+		conflictID = "0f9e8d7c-6b5a-4c3d-8e2f-1a0b9c8d7e6f"
+	)
+	srv := Server{
+		DB: callbackDB{
+			restoreUserByID: func(id string) error {
+				switch id {
+				case deletedID:
+					return nil
+				case conflictID:
+					return ErrConflict{wraperr{errors.New("FAKE ERROR")}}
+				default:
+					return ErrNotFound{wraperr{errors.New("FAKE ERROR")}}
+				}
+			},
+		},
+	}
+	r := mux.NewRouter()
+	srv.RegisterAt(r)
+
+	tests := []struct {
+		id         string
+		wantStatus int
+	}{
+		{deletedID, http.StatusNoContent},
+		{conflictID, http.StatusConflict},
+		{"6ba7b810-9dad-11d1-80b4-00c04fd430c8", http.StatusNotFound},
+		{"not-an-id", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/v1/users/by-id/"+tt.id+"/restore", nil))
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: want status %d, have %d: %s", tt.id, tt.wantStatus, w.Code, w.Body)
+		}
+	}
+}
@@ -1,11 +1,21 @@
 module github.com/akavel/homework200301
 
-go 1.13
+go 1.15
 
 require (
 	github.com/go-pg/pg/v9 v9.1.5
 	github.com/gorilla/mux v1.7.4
 	github.com/jamiealquiza/envy v1.1.0
+	github.com/nyaruka/phonenumbers v1.0.55
+	github.com/prometheus/client_golang v1.5.1
 	github.com/spf13/cobra v0.0.7 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/xeipuuv/gojsonschema v1.2.0
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.1
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	golang.org/x/net v0.0.0-20200822124328-c89045814202
+	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 )
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Group is a named set of users, e.g. a team or a cohort. A user can belong
+// to many groups.
+type Group struct {
+	Name        string `json:"name" pg:",pk"`
+	Description string `json:"description" pg:",use_zero"`
+}
+
+// Validate checks if the Group can be stored.
+func (g *Group) Validate() error {
+	if !validGroupName(g.Name) {
+		return errors.New(".name must be between 1 and 64 characters long, and may only contain lowercase letters, digits, and: . - _")
+	}
+	if len(g.Description) > 1000 {
+		return errors.New(".description must be at most 1000 characters long")
+	}
+	return nil
+}
+
+func validGroupName(name string) bool {
+	if len(name) == 0 || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+		case strings.ContainsRune(".-_", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) listGroups(w http.ResponseWriter, r *http.Request) {
+	list, err := s.DB.ListGroups(r.Context())
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if list == nil {
+		list = []*Group{}
+	}
+	RespondJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) getGroup(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !validGroupName(name) {
+		RespondJSON(w, http.StatusNotFound, nil)
+		return
+	}
+
+	found, err := s.DB.GetGroup(r.Context(), name)
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if found != nil {
+		RespondJSON(w, http.StatusOK, found)
+	} else {
+		RespondJSON(w, http.StatusNotFound, nil)
+	}
+}
+
+func (s *Server) createGroup(w http.ResponseWriter, r *http.Request) {
+	var g Group
+	status, err := DecodeJSON(r, s.maxBodyBytes(), &g)
+	if err != nil {
+		RespondError(w, status, err)
+		return
+	}
+	err = g.Validate()
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.DB.CreateGroup(r.Context(), &g)
+	if err != nil {
+		if errors.As(err, &ErrConflict{}) {
+			RespondError(w, http.StatusConflict, errors.New("group with the same .name already exists"))
+			return
+		}
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Add("Location", s.baseURL(r)+"/v1/groups/"+g.Name)
+	RespondJSON(w, http.StatusCreated, &g)
+}
+
+func (s *Server) modifyGroup(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !validGroupName(name) {
+		RespondError(w, http.StatusNotFound, errors.New("group not found"))
+		return
+	}
+
+	var g Group
+	status, err := DecodeJSON(r, s.maxBodyBytes(), &g)
+	if err != nil {
+		RespondError(w, status, err)
+		return
+	}
+	err = g.Validate()
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if g.Name != name {
+		RespondError(w, http.StatusBadRequest, errors.New(".name field does not match the value in the URL"))
+		return
+	}
+
+	err = s.DB.ModifyGroup(r.Context(), &g)
+	if err != nil {
+		if errors.As(err, &ErrNotFound{}) {
+			RespondError(w, http.StatusNotFound, err)
+			return
+		}
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) deleteGroup(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !validGroupName(name) {
+		RespondError(w, http.StatusNotFound, errors.New("group not found"))
+		return
+	}
+
+	err := s.DB.DeleteGroup(r.Context(), name)
+	if err != nil {
+		if errors.As(err, &ErrNotFound{}) {
+			RespondError(w, http.StatusNotFound, err)
+			return
+		}
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// listGroupMembers responds with users belonging to a group. It accepts the
+// same query parameters as listUsers, so by default only active users are
+// listed.
+func (s *Server) listGroupMembers(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !validGroupName(name) {
+		RespondError(w, http.StatusNotFound, errors.New("group not found"))
+		return
+	}
+	filter, err := NewUserFilter(r.URL.Query())
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if filter.Group != nil && *filter.Group != name {
+		RespondError(w, http.StatusBadRequest, errors.New("'group' query parameter does not match the value in the URL"))
+		return
+	}
+	filter.Group = &name
+
+	found, err := s.DB.GetGroup(r.Context(), name)
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if found == nil {
+		RespondError(w, http.StatusNotFound, errors.New("group not found"))
+		return
+	}
+
+	users, err := s.DB.ListUsers(r.Context(), filter)
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if users == nil {
+		users = []*User{}
+	}
+	RespondJSON(w, http.StatusOK, users)
+}
+
+func (s *Server) addGroupMember(w http.ResponseWriter, r *http.Request) {
+	name, id := mux.Vars(r)["name"], mux.Vars(r)["id"]
+	if !validGroupName(name) || !validPublicID(id) {
+		RespondError(w, http.StatusNotFound, errors.New("group or user not found"))
+		return
+	}
+
+	err := s.DB.AddGroupMember(r.Context(), name, id)
+	if err != nil {
+		if errors.As(err, &ErrNotFound{}) {
+			RespondError(w, http.StatusNotFound, err)
+			return
+		}
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) removeGroupMember(w http.ResponseWriter, r *http.Request) {
+	name, id := mux.Vars(r)["name"], mux.Vars(r)["id"]
+	if !validGroupName(name) || !validPublicID(id) {
+		RespondError(w, http.StatusNotFound, errors.New("group member not found"))
+		return
+	}
+
+	err := s.DB.RemoveGroupMember(r.Context(), name, id)
+	if err != nil {
+		if errors.As(err, &ErrNotFound{}) {
+			RespondError(w, http.StatusNotFound, err)
+			return
+		}
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) listUserGroups(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !validPublicID(id) {
+		RespondError(w, http.StatusNotFound, errors.New("user not found"))
+		return
+	}
+
+	list, err := s.DB.ListUserGroups(r.Context(), id)
+	if err != nil {
+		if errors.As(err, &ErrNotFound{}) {
+			RespondError(w, http.StatusNotFound, err)
+			return
+		}
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if list == nil {
+		list = []*Group{}
+	}
+	RespondJSON(w, http.StatusOK, list)
+}
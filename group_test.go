@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestServer_Groups(t *testing.T) {
+	const (
+		johnID = "7b1a8c3e-2f4d-4e5a-9b6c-0d1e2f3a4b5c"
+		janeID = "0f9e8d7c-6b5a-4c3d-8e2f-1a0b9c8d7e6f"
+	)
+	groups := map[string]*Group{"core": {Name: "core"}}
+	members := map[string]bool{}
+	var lastFilter UserFilter
+	srv := Server{
+		DB: callbackDB{
+			getGroup: func(name string) (*Group, error) { return groups[name], nil },
+			createGroup: func(g *Group) error {
+				if groups[g.Name] != nil {
+					return ErrConflict{wraperr{errors.New("FAKE ERROR")}}
+				}
+				groups[g.Name] = g
+				return nil
+			},
+			deleteGroup: func(name string) error {
+				if groups[name] == nil {
+					return ErrNotFound{wraperr{errors.New("FAKE ERROR")}}
+				}
+				delete(groups, name)
+				return nil
+			},
+			addGroupMember: func(group, userID string) error {
+				if groups[group] == nil || userID != johnID {
+					return ErrNotFound{wraperr{errors.New("FAKE ERROR")}}
+				}
+				members[group+" "+userID] = true
+				return nil
+			},
+			removeGroupMember: func(group, userID string) error {
+				if !members[group+" "+userID] {
+					return ErrNotFound{wraperr{errors.New("FAKE ERROR")}}
+				}
+				delete(members, group+" "+userID)
+				return nil
+			},
+			listUserGroups: func(userID string) ([]*Group, error) {
+				if userID != johnID {
+					return nil, ErrNotFound{wraperr{errors.New("FAKE ERROR")}}
+				}
+				return nil, nil
+			},
+			listUsers: func(filter UserFilter) ([]*User, error) {
+				lastFilter = filter
+				return nil, nil
+			},
+		},
+	}
+	r := mux.NewRouter()
+	srv.RegisterAt(r)
+
+	tests := []struct {
+		comment    string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"invalid name", "POST", "/v1/groups", `{"name": "Core Team"}`, http.StatusBadRequest, "name"},
+		{"duplicate", "POST", "/v1/groups", `{"name": "core"}`, http.StatusConflict, ""},
+		{"create", "POST", "/v1/groups", `{"name": "cohort-2020", "description": "Class of 2020"}`, http.StatusCreated, "Class of 2020"},
+		{"get", "GET", "/v1/groups/cohort-2020", ``, http.StatusOK, "cohort-2020"},
+		{"get missing", "GET", "/v1/groups/nope", ``, http.StatusNotFound, ""},
+		{"name mismatch", "PUT", "/v1/groups/core", `{"name": "web"}`, http.StatusBadRequest, "name"},
+		{"modify invalid name", "PUT", "/v1/groups/Core%20Team", `{"name": "Core Team"}`, http.StatusNotFound, "not found"},
+		{"add member", "PUT", "/v1/groups/core/members/" + johnID, ``, http.StatusNoContent, ""},
+		{"add member again", "PUT", "/v1/groups/core/members/" + johnID, ``, http.StatusNoContent, ""},
+		{"add unknown user", "PUT", "/v1/groups/core/members/" + janeID, ``, http.StatusNotFound, ""},
+		{"add to unknown group", "PUT", "/v1/groups/web/members/" + johnID, ``, http.StatusNotFound, ""},
+		{"add invalid ID", "PUT", "/v1/groups/core/members/john", ``, http.StatusNotFound, ""},
+		{"list members", "GET", "/v1/groups/core/members", ``, http.StatusOK, "[]"},
+		{"list members of unknown group", "GET", "/v1/groups/web/members", ``, http.StatusNotFound, ""},
+		{"list members with other group", "GET", "/v1/groups/core/members?group=web", ``, http.StatusBadRequest, "group"},
+		{"list user groups", "GET", "/v1/users/by-id/" + johnID + "/groups", ``, http.StatusOK, "[]"},
+		{"list unknown user groups", "GET", "/v1/users/by-id/" + janeID + "/groups", ``, http.StatusNotFound, ""},
+		{"remove member", "DELETE", "/v1/groups/core/members/" + johnID, ``, http.StatusNoContent, ""},
+		{"remove non-member", "DELETE", "/v1/groups/core/members/" + johnID, ``, http.StatusNotFound, ""},
+		{"delete", "DELETE", "/v1/groups/cohort-2020", ``, http.StatusNoContent, ""},
+		{"delete missing", "DELETE", "/v1/groups/cohort-2020", ``, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		rq := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		rq.Header.Set("Content-Type", "application/json")
+		rs := httptest.NewRecorder()
+		r.ServeHTTP(rs, rq)
+		if rs.Code != tt.wantStatus {
+			t.Errorf("%q: want status %d, have %d: %s", tt.comment, tt.wantStatus, rs.Code, rs.Body.String())
+		}
+		if !strings.Contains(rs.Body.String(), tt.wantBody) {
+			t.Errorf("%q: want reply with %q, have: %s", tt.comment, tt.wantBody, rs.Body.String())
+		}
+	}
+
+	// Members are listed with the usual user filters, hiding deleted users
+	// by default
+	rq := httptest.NewRequest("GET", "/v1/groups/core/members?technology=go", nil)
+	r.ServeHTTP(httptest.NewRecorder(), rq)
+	if lastFilter.Group == nil || *lastFilter.Group != "core" ||
+		lastFilter.Technology == nil || *lastFilter.Technology != "go" ||
+		lastFilter.Deleted == nil || *lastFilter.Deleted {
+		t.Errorf("unexpected filter: %+v", lastFilter)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// StartShutdown marks the Server as shutting down, making the readiness
+// endpoint fail, so that load balancers stop routing new requests to it.
+func (s *Server) StartShutdown() {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+}
+
+// healthz reports that the process is alive and able to serve HTTP requests.
+// It intentionally does not check any dependencies.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	RespondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz reports whether the Server is ready to handle API requests: the
+// database must be reachable, its schema up to date, and the Server must not be
+// shutting down.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+	fail := func(check, msg string) {
+		checks[check] = msg
+		ready = false
+	}
+
+	if atomic.LoadInt32(&s.shuttingDown) != 0 {
+		fail("shutdown", "shutting down")
+	} else {
+		checks["shutdown"] = "ok"
+	}
+
+	// Note: errors are not included in the response to avoid leaking internal
+	// details to unauthenticated callers.
+	if err := s.DB.Ping(r.Context()); err != nil {
+		fail("database", "unreachable")
+	} else {
+		checks["database"] = "ok"
+	}
+	switch pending, err := s.DB.PendingMigrations(r.Context()); {
+	case err != nil:
+		fail("migrations", "unknown")
+	case pending > 0:
+		fail("migrations", "pending")
+	default:
+		checks["migrations"] = "ok"
+	}
+
+	if !ready {
+		RespondJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"status": "unavailable",
+			"checks": checks,
+		})
+		return
+	}
+	RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "ok",
+		"checks": checks,
+	})
+}
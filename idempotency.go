@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader is the request header by which clients mark retries
+// of the same request. See:
+// https://datatracker.ietf.org/doc/draft-ietf-httpapi-idempotency-key-header/
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// replayedResponseHeaders are the headers of a response stored for replaying.
+// Other headers, like X-Homework-Request-ID, are specific to a single request.
+var replayedResponseHeaders = []string{"Content-Type", "Location"}
+
+var (
+	// ErrIdempotencyInProgress is returned by IdempotencyStore.Begin if the
+	// first request with the same key is still being handled.
+	ErrIdempotencyInProgress = errors.New("a request with the same " + IdempotencyKeyHeader + " is still in progress")
+	// ErrIdempotencyMismatch is returned by IdempotencyStore.Begin if the key
+	// was used for a request with a different body.
+	ErrIdempotencyMismatch = errors.New(IdempotencyKeyHeader + " was already used for a request with different body")
+)
+
+// StoredResponse is an HTTP response recorded for replaying.
+type StoredResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// IdempotencyStore keeps responses to requests with idempotency keys.
+// Implementations must be safe for concurrent use.
+type IdempotencyStore interface {
+	// Begin reserves key for a request with the provided body fingerprint. If
+	// a response was already stored under key for the same fingerprint, it is
+	// returned and the request must not be handled again.
+	Begin(key, fingerprint string) (*StoredResponse, error)
+	// Finish stores the response to the request which reserved key. If rs is
+	// nil, the reservation is released, allowing a retry to be handled anew.
+	Finish(key string, rs *StoredResponse)
+}
+
+// MemoryIdempotencyStore keeps responses in memory of the process, each for
+// the duration of TTL since the request was received.
+type MemoryIdempotencyStore struct {
+	ttl time.Duration
+	now func() time.Time // for tests
+
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	lastSweep time.Time
+}
+
+type idempotencyEntry struct {
+	fingerprint string
+	response    *StoredResponse // nil while in progress
+	expires     time.Time
+}
+
+func NewMemoryIdempotencyStore(ttl time.Duration) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[string]*idempotencyEntry{},
+	}
+}
+
+func (s *MemoryIdempotencyStore) Begin(key, fingerprint string) (*StoredResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if now.Sub(s.lastSweep) >= time.Minute {
+		for k, e := range s.entries {
+			if now.After(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	e := s.entries[key]
+	switch {
+	case e == nil || now.After(e.expires):
+		s.entries[key] = &idempotencyEntry{fingerprint: fingerprint, expires: now.Add(s.ttl)}
+		return nil, nil
+	case e.fingerprint != fingerprint:
+		return nil, ErrIdempotencyMismatch
+	case e.response == nil:
+		return nil, ErrIdempotencyInProgress
+	default:
+		return e.response, nil
+	}
+}
+
+func (s *MemoryIdempotencyStore) Finish(key string, rs *StoredResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rs == nil {
+		delete(s.entries, key)
+		return
+	}
+	if e := s.entries[key]; e != nil {
+		e.response = rs
+	}
+}
+
+// idempotent wraps a handler of a non-idempotent operation, so that requests
+// with an Idempotency-Key header are handled only once, and retries get the
+// stored response of the first one. Server errors are not stored, to let the
+// client retry them.
+func (s *Server) idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if s.Idempotency == nil || key == "" {
+			h(w, r)
+			return
+		}
+		if len(key) > 255 {
+			RespondError(w, http.StatusBadRequest, fmt.Errorf("%s longer than 255 characters", IdempotencyKeyHeader))
+			return
+		}
+
+		// Read one byte more than allowed, so that handler can detect too
+		// long bodies
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, s.maxBodyBytes()+1))
+		if err != nil {
+			RespondError(w, http.StatusBadRequest, fmt.Errorf("reading request body: %w", err))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+
+		// Keys are chosen by clients, so they are scoped to the client, to
+		// avoid replaying responses to others
+		key = clientKey(r, s.ClientKeyHeader) + " " + r.Method + " " + r.URL.Path + " " + key
+		stored, err := s.Idempotency.Begin(key, hex.EncodeToString(sum[:]))
+		switch {
+		case err == ErrIdempotencyMismatch:
+			RespondError(w, http.StatusUnprocessableEntity, err)
+			return
+		case err == ErrIdempotencyInProgress:
+			RespondError(w, http.StatusConflict, err)
+			return
+		case err != nil:
+			RespondError(w, http.StatusInternalServerError, err)
+			return
+		case stored != nil:
+			for k, v := range stored.Header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		rec := &bufferingRecorder{responseRecorder: responseRecorder{ResponseWriter: w}}
+		var result *StoredResponse
+		// Release the key also if the handler panics
+		defer func() { s.Idempotency.Finish(key, result) }()
+		h(rec, r)
+
+		if rec.Status() >= 500 {
+			return
+		}
+		result = &StoredResponse{
+			Status: rec.Status(),
+			Header: http.Header{},
+			Body:   rec.body.Bytes(),
+		}
+		for _, k := range replayedResponseHeaders {
+			if v, ok := w.Header()[k]; ok {
+				result.Header[k] = v
+			}
+		}
+	}
+}
+
+// bufferingRecorder is a responseRecorder which additionally keeps a copy of
+// the response body.
+type bufferingRecorder struct {
+	responseRecorder
+	body bytes.Buffer
+}
+
+func (w *bufferingRecorder) Write(buf []byte) (int, error) {
+	w.body.Write(buf)
+	return w.responseRecorder.Write(buf)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestServer_PostUser_Idempotency(t *testing.T) {
+	created := 0
+	fail := false
+	srv := Server{
+		DB: callbackDB{
+			createUser: func(u *User) error {
+				if fail {
+					return errors.New("FAKE ERROR")
+				}
+				created++
+				if created > 1 {
+					return ErrConflict{wraperr{errors.New("FAKE ERROR")}}
+				}
+				return nil
+			},
+		},
+		BaseURL:     "TEST",
+		Idempotency: NewMemoryIdempotencyStore(time.Hour),
+	}
+	r := mux.NewRouter()
+	srv.RegisterAt(r)
+
+	post := func(key, body string) *httptest.ResponseRecorder {
+		rq := httptest.NewRequest("POST", "/v1/user", strings.NewReader(body))
+		rq.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			rq.Header.Set(IdempotencyKeyHeader, key)
+		}
+		rs := httptest.NewRecorder()
+		r.ServeHTTP(rs, rq)
+		return rs
+	}
+
+	first := post("key-1", validJohnSmith)
+	if first.Code >= 300 {
+		t.Fatalf("first request: unexpected status %d: %s", first.Code, first.Body.String())
+	}
+	retry := post("key-1", validJohnSmith)
+	if retry.Code != first.Code || retry.Body.String() != first.Body.String() {
+		t.Errorf("retry: want replayed %d %q, have %d %q", first.Code, first.Body.String(), retry.Code, retry.Body.String())
+	}
+	if have, want := retry.Header().Get("Location"), first.Header().Get("Location"); have != want || want == "" {
+		t.Errorf("retry: want Location %q, have %q", want, have)
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry: missing Idempotent-Replayed header")
+	}
+	if created != 1 {
+		t.Errorf("want user created once, have %d", created)
+	}
+
+	// Keys of other clients are separate
+	rq := httptest.NewRequest("POST", "/v1/user", strings.NewReader(validJohnSmith))
+	rq.Header.Set("Content-Type", "application/json")
+	rq.Header.Set(IdempotencyKeyHeader, "key-1")
+	rq.RemoteAddr = "198.51.100.7:4321"
+	rs := httptest.NewRecorder()
+	r.ServeHTTP(rs, rq)
+	if rs.Code != http.StatusConflict || rs.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("other client: want handled anew with status %d, have %d: %s", http.StatusConflict, rs.Code, rs.Body.String())
+	}
+
+	other := strings.Replace(validJohnSmith, "John", "Jack", 1)
+	if rs := post("key-1", other); rs.Code != http.StatusUnprocessableEntity {
+		t.Errorf("different body: want status %d, have %d", http.StatusUnprocessableEntity, rs.Code)
+	}
+	if rs := post("", validJohnSmith); rs.Code != http.StatusConflict {
+		t.Errorf("no key: want status %d, have %d", http.StatusConflict, rs.Code)
+	}
+
+	// Server errors are not stored
+	fail = true
+	if rs := post("key-2", validJohnSmith); rs.Code != http.StatusInternalServerError {
+		t.Errorf("failing request: want status %d, have %d", http.StatusInternalServerError, rs.Code)
+	}
+	fail = false
+	created = 0
+	if rs := post("key-2", validJohnSmith); rs.Code >= 300 || created != 1 {
+		t.Errorf("retry of failed request: want handled anew, have status %d, created %d", rs.Code, created)
+	}
+}
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	store := NewMemoryIdempotencyStore(time.Minute)
+	store.now = func() time.Time { return now }
+
+	if rs, err := store.Begin("k", "a"); rs != nil || err != nil {
+		t.Fatalf("first Begin: want nil, nil; have %v, %v", rs, err)
+	}
+	if _, err := store.Begin("k", "a"); err != ErrIdempotencyInProgress {
+		t.Errorf("Begin in progress: want %v, have %v", ErrIdempotencyInProgress, err)
+	}
+	store.Finish("k", &StoredResponse{Status: 201})
+	if rs, err := store.Begin("k", "a"); err != nil || rs == nil || rs.Status != 201 {
+		t.Errorf("Begin after Finish: want stored response, have %v, %v", rs, err)
+	}
+	if _, err := store.Begin("k", "b"); err != ErrIdempotencyMismatch {
+		t.Errorf("Begin with other fingerprint: want %v, have %v", ErrIdempotencyMismatch, err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if rs, err := store.Begin("k", "b"); rs != nil || err != nil {
+		t.Errorf("Begin after TTL: want nil, nil; have %v, %v", rs, err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mail is a plain text email message.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email messages, e.g. for verifying email addresses of users.
+type Mailer interface {
+	Send(ctx context.Context, m *Mail) error
+}
+
+// Format returns m as an RFC 5322 message from the specified address, with
+// lines ending in CRLF. Addresses containing line breaks are rejected, so
+// that they can't inject headers.
+func (m *Mail) Format(from string, date time.Time) ([]byte, error) {
+	if strings.ContainsAny(from+m.To, "\r\n") {
+		return nil, errors.New("email address must not contain line breaks")
+	}
+	var buf bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", name, value)
+	}
+	header("From", from)
+	header("To", m.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", strings.Join(strings.Fields(m.Subject), " ")))
+	header("Date", date.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	buf.WriteString("\r\n")
+	w := quotedprintable.NewWriter(&buf)
+	w.Write([]byte(strings.Replace(m.Body, "\n", "\r\n", -1)))
+	w.Close()
+	return buf.Bytes(), nil
+}
+
+// WriterMailer writes messages to a Writer instead of sending them, separated
+// by a line of dashes. It is meant for local runs, with os.Stdout or a file.
+type WriterMailer struct {
+	W    io.Writer
+	From string
+
+	mu sync.Mutex
+}
+
+func (m *WriterMailer) Send(_ context.Context, mail *Mail) error {
+	msg, err := mail.Format(m.From, time.Now())
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err = fmt.Fprintf(m.W, "%s\r\n-----\r\n", msg)
+	return err
+}
+
+// SMTPMailer sends messages via an SMTP server. STARTTLS is used if the
+// server supports it; authentication (PLAIN) is used if Username is not
+// empty, and then requires TLS, unless the server is on localhost.
+type SMTPMailer struct {
+	// Addr is the host:port of the server.
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg *Mail) error {
+	buf, err := msg.Format(m.From, time.Now())
+	if err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(m.Addr)
+	if err != nil {
+		return fmt.Errorf("bad SMTP server address: %w", err)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", m.Addr)
+	if err != nil {
+		return fmt.Errorf("connecting to SMTP server: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("connecting to SMTP server: %w", err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return fmt.Errorf("starting TLS: %w", err)
+		}
+	}
+	if m.Username != "" {
+		err = c.Auth(smtp.PlainAuth("", m.Username, m.Password, host))
+		if err != nil {
+			return fmt.Errorf("authenticating to SMTP server: %w", err)
+		}
+	}
+	// The envelope needs the bare address, without a display name
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("bad sender address: %w", err)
+	}
+	err = c.Mail(from.Address)
+	if err != nil {
+		return fmt.Errorf("sending email: %w", err)
+	}
+	err = c.Rcpt(msg.To)
+	if err != nil {
+		return fmt.Errorf("sending email: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("sending email: %w", err)
+	}
+	_, err = w.Write(buf)
+	if err != nil {
+		return fmt.Errorf("sending email: %w", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("sending email: %w", err)
+	}
+	return c.Quit()
+}
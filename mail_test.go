@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMail_Format(t *testing.T) {
+	m := &Mail{
+		To:      "john@smith.com",
+		Subject: "Zażółć\ngęślą jaźń",
+		Body:    "Hello,\nthe link: https://example.com/verify?token=a.b=c\n",
+	}
+	have, err := m.Format("Users <users@example.com>", time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "From: Users <users@example.com>\r\n" +
+		"To: john@smith.com\r\n" +
+		"Subject: =?utf-8?q?Za=C5=BC=C3=B3=C5=82=C4=87_g=C4=99=C5=9Bl=C4=85_ja=C5=BA=C5=84?=\r\n" +
+		"Date: Sun, 01 Mar 2020 12:00:00 +0000\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Hello,\r\nthe link: https://example.com/verify?token=3Da.b=3Dc\r\n"
+	if string(have) != want {
+		t.Errorf("want:\n%s\nhave:\n%s", want, have)
+	}
+
+	// Header injection
+	for _, to := range []string{"john@smith.com\r\nBcc: all@example.com", "john@smith.com\nBcc: all@example.com"} {
+		m := &Mail{To: to, Subject: "Hi"}
+		if _, err := m.Format("users@example.com", time.Now()); err == nil {
+			t.Errorf("%q: want error", to)
+		}
+	}
+}
+
+func TestWriterMailer(t *testing.T) {
+	var buf bytes.Buffer
+	m := &WriterMailer{W: &buf, From: "users@example.com"}
+	for _, to := range []string{"a@example.com", "b@example.com"} {
+		err := m.Send(context.Background(), &Mail{To: to, Subject: "Hi", Body: "Hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs := strings.Split(buf.String(), "\r\n-----\r\n")
+	if len(msgs) != 3 || !strings.Contains(msgs[0], "To: a@example.com\r\n") || !strings.Contains(msgs[1], "To: b@example.com\r\n") || msgs[2] != "" {
+		t.Errorf("bad output:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Metadata holds custom attributes of a User, attached by other services and
+// teams, e.g. employee number or team name. Values can be arbitrary JSON.
+type Metadata map[string]json.RawMessage
+
+const (
+	// MaxMetadataKeys is the maximum number of keys in Metadata of a User.
+	MaxMetadataKeys = 50
+	// MaxMetadataBytes is the maximum size of Metadata of a User, encoded
+	// as compact JSON.
+	MaxMetadataBytes = 8 << 10
+)
+
+var metadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// metadataSchemas holds JSON Schemas which values of the corresponding keys
+// of Metadata must conform to. Keys without a schema can have any value. See
+// LoadMetadataSchemas.
+var metadataSchemas = map[string]*gojsonschema.Schema{}
+
+// LoadMetadataSchemas reads a JSON file containing an object which maps
+// Metadata keys to JSON Schemas, and sets them for validating Metadata. For
+// example:
+//
+//	{"employee_number": {"type": "integer", "minimum": 1}}
+//
+// It must be called before any User is validated.
+func LoadMetadataSchemas(path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	schemas, err := ParseMetadataSchemas(buf)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	metadataSchemas = schemas
+	return nil
+}
+
+// ParseMetadataSchemas compiles JSON Schemas keyed by Metadata keys, as
+// described in LoadMetadataSchemas.
+func ParseMetadataSchemas(buf []byte) (map[string]*gojsonschema.Schema, error) {
+	var raw map[string]json.RawMessage
+	err := json.Unmarshal(buf, &raw)
+	if err != nil {
+		return nil, err
+	}
+	schemas := map[string]*gojsonschema.Schema{}
+	for key, schema := range raw {
+		if !metadataKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("invalid metadata key %q", key)
+		}
+		schemas[key], err = gojsonschema.NewSchema(gojsonschema.NewBytesLoader(schema))
+		if err != nil {
+			return nil, fmt.Errorf("schema of metadata key %q: %w", key, err)
+		}
+	}
+	return schemas, nil
+}
+
+// Validate checks if Metadata fits in size limits, and if values conform to
+// schemas configured for their keys. Values are compacted, to make the size
+// independent of formatting.
+func (m Metadata) Validate() error {
+	if len(m) > MaxMetadataKeys {
+		return fmt.Errorf(".metadata must have at most %d keys", MaxMetadataKeys)
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	// Check keys in fixed order, so that errors are repeatable
+	sort.Strings(keys)
+	size := 2 // {}
+	for _, key := range keys {
+		if !metadataKeyPattern.MatchString(key) {
+			return fmt.Errorf(".metadata key %q must have 1 to 64 characters: letters, digits, _ or -", key)
+		}
+		var buf bytes.Buffer
+		err := json.Compact(&buf, m[key])
+		if err != nil {
+			return fmt.Errorf(".metadata.%s is not valid JSON: %w", key, err)
+		}
+		m[key] = buf.Bytes()
+		size += len(key) + 4 + buf.Len() // "key":value,
+
+		schema := metadataSchemas[key]
+		if schema == nil {
+			continue
+		}
+		result, err := schema.Validate(gojsonschema.NewBytesLoader(m[key]))
+		if err != nil {
+			return fmt.Errorf(".metadata.%s: %w", key, err)
+		}
+		if !result.Valid() {
+			var errs []string
+			for _, e := range result.Errors() {
+				errs = append(errs, e.String())
+			}
+			return fmt.Errorf(".metadata.%s does not match schema: %s", key, strings.Join(errs, "; "))
+		}
+	}
+	if size > MaxMetadataBytes {
+		return fmt.Errorf(".metadata must be at most %d bytes long as JSON", MaxMetadataBytes)
+	}
+	return nil
+}
+
+// metadataFilterValues returns JSON values matched by a value of a
+// metadata.<key> query parameter: the value as a JSON string, and also as
+// a JSON number, boolean or null, if it is one.
+func metadataFilterValues(v string) []json.RawMessage {
+	asString, _ := json.Marshal(v)
+	values := []json.RawMessage{asString}
+	var scalar interface{}
+	if json.Unmarshal([]byte(v), &scalar) == nil {
+		switch scalar.(type) {
+		case float64, bool, nil:
+			values = append(values, json.RawMessage(v))
+		}
+	}
+	return values
+}
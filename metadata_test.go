@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMetadata_Validate(t *testing.T) {
+	schemas, err := ParseMetadataSchemas([]byte(`{
+		"employee_number": {"type": "integer", "minimum": 1},
+		"team": {"type": "string", "enum": ["core", "web"]}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSchemas := metadataSchemas
+	metadataSchemas = schemas
+	defer func() { metadataSchemas = oldSchemas }()
+
+	m := Metadata{
+		"employee_number": json.RawMessage(`17`),
+		"team":            json.RawMessage(` "core" `),
+		"slack":           json.RawMessage(`{ "handle": "@john" }`),
+	}
+	err = m.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := string(m["slack"]); have != `{"handle":"@john"}` {
+		t.Errorf("want compacted value, have %s", have)
+	}
+
+	tooMany := Metadata{}
+	for i := 0; i <= MaxMetadataKeys; i++ {
+		tooMany[fmt.Sprint("k", i)] = json.RawMessage(`1`)
+	}
+	tests := []struct {
+		comment string
+		m       Metadata
+		wantErr string
+	}{
+		{"schema mismatch", Metadata{"employee_number": json.RawMessage(`0`)}, "employee_number"},
+		{"schema mismatch in enum", Metadata{"team": json.RawMessage(`"ops"`)}, "team"},
+		{"invalid key", Metadata{"a.b": json.RawMessage(`1`)}, "a.b"},
+		{"too many keys", tooMany, "keys"},
+		{"too large", Metadata{"x": json.RawMessage(`"` + strings.Repeat("x", MaxMetadataBytes) + `"`)}, "bytes"},
+	}
+	for _, tt := range tests {
+		err := tt.m.Validate()
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: want error with %q, have: %v", tt.comment, tt.wantErr, err)
+		}
+	}
+}
+
+func TestParseMetadataSchemas_Invalid(t *testing.T) {
+	for _, bad := range []string{`[]`, `{"a b": {}}`, `{"x": {"type": "no-such-type"}}`} {
+		if _, err := ParseMetadataSchemas([]byte(bad)); err == nil {
+			t.Errorf("%s: want error", bad)
+		}
+	}
+}
+
+func TestMetadataFilterValues(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"core", []string{`"core"`}},
+		{"123", []string{`"123"`, `123`}},
+		{"true", []string{`"true"`, `true`}},
+		{`"quoted"`, []string{`"\"quoted\""`}},
+	}
+	for _, tt := range tests {
+		var have []string
+		for _, v := range metadataFilterValues(tt.value) {
+			have = append(have, string(v))
+		}
+		if !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("%q: want %q, have %q", tt.value, tt.want, have)
+		}
+	}
+}
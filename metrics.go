@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics collects Prometheus metrics about HTTP requests served, and
+// operations on the Database.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+	dbDuration   *prometheus.HistogramVec
+	dbErrors     *prometheus.CounterVec
+}
+
+// NewMetrics creates a new Metrics object, with its own registry. Besides the
+// HTTP and Database metrics, the registry also exposes standard Go runtime and
+// process metrics.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "users_http_requests_total",
+			Help: "Number of HTTP requests served, by route template and response status.",
+		}, []string{"method", "route", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "users_http_request_duration_seconds",
+			Help:    "Latency of HTTP requests, by route template and response status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		dbDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "users_db_operation_duration_seconds",
+			Help:    "Latency of Database operations, by method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation"}),
+		dbErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "users_db_operation_errors_total",
+			Help: "Number of Database operations which returned an error, by method and error kind.",
+		}, []string{"operation", "kind"}),
+	}
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.httpRequests,
+		m.httpDuration,
+		m.dbDuration,
+		m.dbErrors,
+	)
+	return m
+}
+
+// Handler returns an HTTP handler serving the metrics in Prometheus format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// WrapRouter records metrics about all HTTP requests handled by router. The
+// metrics are labelled with the template of the matched route (e.g.
+// /v1/user/{email}), to avoid putting user data (and unbounded number of
+// values) into labels. Requests not matching any route (e.g. 404 and 405
+// responses) are labelled as "unmatched".
+//
+// Note: the router is wrapped instead of using a mux middleware, as mux
+// runs middlewares only for matched routes.
+func (m *Metrics) WrapRouter(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.MatchErr == nil && match.Route != nil {
+			if tmpl, err := match.Route.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		router.ServeHTTP(rec, r)
+
+		status := strconv.Itoa(rec.Status())
+		m.httpRequests.WithLabelValues(r.Method, route, status).Inc()
+		m.httpDuration.WithLabelValues(r.Method, route, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// observeDB records the duration and outcome of a Database operation started
+// at the specified time.
+func (m *Metrics) observeDB(operation string, start time.Time, err error) {
+	m.dbDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	switch {
+	case err == nil:
+		// ok
+	case errors.As(err, &ErrNotFound{}):
+		m.dbErrors.WithLabelValues(operation, "not_found").Inc()
+	case errors.As(err, &ErrConflict{}):
+		m.dbErrors.WithLabelValues(operation, "conflict").Inc()
+	case errors.As(err, &ErrInvalid{}):
+		m.dbErrors.WithLabelValues(operation, "invalid").Inc()
+	default:
+		m.dbErrors.WithLabelValues(operation, "other").Inc()
+	}
+}
+
+// InstrumentDatabase returns a Database recording metrics about all
+// operations performed on db.
+func (m *Metrics) InstrumentDatabase(db Database) Database {
+	return &instrumentedDB{db: db, m: m}
+}
+
+type instrumentedDB struct {
+	db Database
+	m  *Metrics
+}
+
+func (i *instrumentedDB) ListUsers(ctx context.Context, filter UserFilter) ([]*User, error) {
+	start := time.Now()
+	users, err := i.db.ListUsers(ctx, filter)
+	i.m.observeDB("ListUsers", start, err)
+	return users, err
+}
+
+func (i *instrumentedDB) GetUser(ctx context.Context, email string) (*User, error) {
+	start := time.Now()
+	u, err := i.db.GetUser(ctx, email)
+	i.m.observeDB("GetUser", start, err)
+	return u, err
+}
+
+func (i *instrumentedDB) GetUserAsOf(ctx context.Context, email string, at time.Time) (*User, error) {
+	start := time.Now()
+	u, err := i.db.GetUserAsOf(ctx, email, at)
+	i.m.observeDB("GetUserAsOf", start, err)
+	return u, err
+}
+
+func (i *instrumentedDB) CreateUser(ctx context.Context, u *User) error {
+	start := time.Now()
+	err := i.db.CreateUser(ctx, u)
+	i.m.observeDB("CreateUser", start, err)
+	return err
+}
+
+func (i *instrumentedDB) ModifyUser(ctx context.Context, u *User) error {
+	start := time.Now()
+	err := i.db.ModifyUser(ctx, u)
+	i.m.observeDB("ModifyUser", start, err)
+	return err
+}
+
+func (i *instrumentedDB) DeleteUser(ctx context.Context, email string) error {
+	start := time.Now()
+	err := i.db.DeleteUser(ctx, email)
+	i.m.observeDB("DeleteUser", start, err)
+	return err
+}
+
+func (i *instrumentedDB) GetUserByID(ctx context.Context, id string) (*User, error) {
+	start := time.Now()
+	u, err := i.db.GetUserByID(ctx, id)
+	i.m.observeDB("GetUserByID", start, err)
+	return u, err
+}
+
+func (i *instrumentedDB) ModifyUserByID(ctx context.Context, id string, u *User) error {
+	start := time.Now()
+	err := i.db.ModifyUserByID(ctx, id, u)
+	i.m.observeDB("ModifyUserByID", start, err)
+	return err
+}
+
+func (i *instrumentedDB) DeleteUserByID(ctx context.Context, id string) error {
+	start := time.Now()
+	err := i.db.DeleteUserByID(ctx, id)
+	i.m.observeDB("DeleteUserByID", start, err)
+	return err
+}
+
+func (i *instrumentedDB) VerifyUserEmail(ctx context.Context, id, emailNorm string) error {
+	start := time.Now()
+	err := i.db.VerifyUserEmail(ctx, id, emailNorm)
+	i.m.observeDB("VerifyUserEmail", start, err)
+	return err
+}
+
+func (i *instrumentedDB) RestoreUserByID(ctx context.Context, id string) error {
+	start := time.Now()
+	err := i.db.RestoreUserByID(ctx, id)
+	i.m.observeDB("RestoreUserByID", start, err)
+	return err
+}
+
+func (i *instrumentedDB) ListUserEvents(ctx context.Context, after int64, limit int) ([]*UserEvent, error) {
+	start := time.Now()
+	events, err := i.db.ListUserEvents(ctx, after, limit)
+	i.m.observeDB("ListUserEvents", start, err)
+	return events, err
+}
+
+func (i *instrumentedDB) ListTechnologies(ctx context.Context) ([]*Technology, error) {
+	start := time.Now()
+	list, err := i.db.ListTechnologies(ctx)
+	i.m.observeDB("ListTechnologies", start, err)
+	return list, err
+}
+
+func (i *instrumentedDB) CreateTechnology(ctx context.Context, t *Technology) error {
+	start := time.Now()
+	err := i.db.CreateTechnology(ctx, t)
+	i.m.observeDB("CreateTechnology", start, err)
+	return err
+}
+
+func (i *instrumentedDB) ModifyTechnology(ctx context.Context, t *Technology) error {
+	start := time.Now()
+	err := i.db.ModifyTechnology(ctx, t)
+	i.m.observeDB("ModifyTechnology", start, err)
+	return err
+}
+
+func (i *instrumentedDB) DeleteTechnology(ctx context.Context, name string) error {
+	start := time.Now()
+	err := i.db.DeleteTechnology(ctx, name)
+	i.m.observeDB("DeleteTechnology", start, err)
+	return err
+}
+
+func (i *instrumentedDB) ListGroups(ctx context.Context) ([]*Group, error) {
+	start := time.Now()
+	list, err := i.db.ListGroups(ctx)
+	i.m.observeDB("ListGroups", start, err)
+	return list, err
+}
+
+func (i *instrumentedDB) GetGroup(ctx context.Context, name string) (*Group, error) {
+	start := time.Now()
+	g, err := i.db.GetGroup(ctx, name)
+	i.m.observeDB("GetGroup", start, err)
+	return g, err
+}
+
+func (i *instrumentedDB) CreateGroup(ctx context.Context, g *Group) error {
+	start := time.Now()
+	err := i.db.CreateGroup(ctx, g)
+	i.m.observeDB("CreateGroup", start, err)
+	return err
+}
+
+func (i *instrumentedDB) ModifyGroup(ctx context.Context, g *Group) error {
+	start := time.Now()
+	err := i.db.ModifyGroup(ctx, g)
+	i.m.observeDB("ModifyGroup", start, err)
+	return err
+}
+
+func (i *instrumentedDB) DeleteGroup(ctx context.Context, name string) error {
+	start := time.Now()
+	err := i.db.DeleteGroup(ctx, name)
+	i.m.observeDB("DeleteGroup", start, err)
+	return err
+}
+
+func (i *instrumentedDB) AddGroupMember(ctx context.Context, group, userID string) error {
+	start := time.Now()
+	err := i.db.AddGroupMember(ctx, group, userID)
+	i.m.observeDB("AddGroupMember", start, err)
+	return err
+}
+
+func (i *instrumentedDB) RemoveGroupMember(ctx context.Context, group, userID string) error {
+	start := time.Now()
+	err := i.db.RemoveGroupMember(ctx, group, userID)
+	i.m.observeDB("RemoveGroupMember", start, err)
+	return err
+}
+
+func (i *instrumentedDB) ListUserGroups(ctx context.Context, userID string) ([]*Group, error) {
+	start := time.Now()
+	list, err := i.db.ListUserGroups(ctx, userID)
+	i.m.observeDB("ListUserGroups", start, err)
+	return list, err
+}
+
+func (i *instrumentedDB) ListWebhooks(ctx context.Context) ([]*Webhook, error) {
+	start := time.Now()
+	list, err := i.db.ListWebhooks(ctx)
+	i.m.observeDB("ListWebhooks", start, err)
+	return list, err
+}
+
+func (i *instrumentedDB) GetWebhook(ctx context.Context, id string) (*Webhook, error) {
+	start := time.Now()
+	h, err := i.db.GetWebhook(ctx, id)
+	i.m.observeDB("GetWebhook", start, err)
+	return h, err
+}
+
+func (i *instrumentedDB) CreateWebhook(ctx context.Context, h *Webhook) error {
+	start := time.Now()
+	err := i.db.CreateWebhook(ctx, h)
+	i.m.observeDB("CreateWebhook", start, err)
+	return err
+}
+
+func (i *instrumentedDB) ModifyWebhook(ctx context.Context, h *Webhook) error {
+	start := time.Now()
+	err := i.db.ModifyWebhook(ctx, h)
+	i.m.observeDB("ModifyWebhook", start, err)
+	return err
+}
+
+func (i *instrumentedDB) DeleteWebhook(ctx context.Context, id string) error {
+	start := time.Now()
+	err := i.db.DeleteWebhook(ctx, id)
+	i.m.observeDB("DeleteWebhook", start, err)
+	return err
+}
+
+func (i *instrumentedDB) ListWebhookDeliveries(ctx context.Context, webhookID, state string) ([]*WebhookDelivery, error) {
+	start := time.Now()
+	list, err := i.db.ListWebhookDeliveries(ctx, webhookID, state)
+	i.m.observeDB("ListWebhookDeliveries", start, err)
+	return list, err
+}
+
+func (i *instrumentedDB) RetryWebhookDelivery(ctx context.Context, webhookID string, id int64) error {
+	start := time.Now()
+	err := i.db.RetryWebhookDelivery(ctx, webhookID, id)
+	i.m.observeDB("RetryWebhookDelivery", start, err)
+	return err
+}
+
+func (i *instrumentedDB) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := i.db.Ping(ctx)
+	i.m.observeDB("Ping", start, err)
+	return err
+}
+
+func (i *instrumentedDB) PendingMigrations(ctx context.Context) (int, error) {
+	start := time.Now()
+	n, err := i.db.PendingMigrations(ctx)
+	i.m.observeDB("PendingMigrations", start, err)
+	return n, err
+}
+
+func (i *instrumentedDB) Close() error { return i.db.Close() }
+
+// RegisterPostgresPool exposes connection pool statistics of db.
+func (m *Metrics) RegisterPostgresPool(db *PostgresDB) {
+	m.registry.MustRegister(pgPoolCollector{db})
+}
+
+var (
+	pgPoolHitsDesc     = prometheus.NewDesc("users_db_pool_hits_total", "Number of times a free connection was found in the pool.", nil, nil)
+	pgPoolMissesDesc   = prometheus.NewDesc("users_db_pool_misses_total", "Number of times a free connection was NOT found in the pool.", nil, nil)
+	pgPoolTimeoutsDesc = prometheus.NewDesc("users_db_pool_timeouts_total", "Number of times a wait for a free connection timed out.", nil, nil)
+	pgPoolTotalDesc    = prometheus.NewDesc("users_db_pool_connections", "Number of connections in the pool.", nil, nil)
+	pgPoolIdleDesc     = prometheus.NewDesc("users_db_pool_idle_connections", "Number of idle connections in the pool.", nil, nil)
+	pgPoolStaleDesc    = prometheus.NewDesc("users_db_pool_stale_connections_total", "Number of stale connections removed from the pool.", nil, nil)
+)
+
+// pgPoolCollector reads go-pg pool statistics on every scrape.
+type pgPoolCollector struct{ db *PostgresDB }
+
+func (c pgPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pgPoolHitsDesc
+	ch <- pgPoolMissesDesc
+	ch <- pgPoolTimeoutsDesc
+	ch <- pgPoolTotalDesc
+	ch <- pgPoolIdleDesc
+	ch <- pgPoolStaleDesc
+}
+
+func (c pgPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.db.PoolStats()
+	ch <- prometheus.MustNewConstMetric(pgPoolHitsDesc, prometheus.CounterValue, float64(s.Hits))
+	ch <- prometheus.MustNewConstMetric(pgPoolMissesDesc, prometheus.CounterValue, float64(s.Misses))
+	ch <- prometheus.MustNewConstMetric(pgPoolTimeoutsDesc, prometheus.CounterValue, float64(s.Timeouts))
+	ch <- prometheus.MustNewConstMetric(pgPoolTotalDesc, prometheus.GaugeValue, float64(s.TotalConns))
+	ch <- prometheus.MustNewConstMetric(pgPoolIdleDesc, prometheus.GaugeValue, float64(s.IdleConns))
+	ch <- prometheus.MustNewConstMetric(pgPoolStaleDesc, prometheus.CounterValue, float64(s.StaleConns))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	srv := Server{
+		DB: metrics.InstrumentDatabase(callbackDB{
+			getUser: func(email string) (*User, error) {
+				if email == "john@smith.com" {
+					return &User{Email: newString(email)}, nil
+				}
+				return nil, errors.New("FAKE ERROR")
+			},
+			deleteUser: func(email string) error {
+				return ErrNotFound{wraperr{errors.New("FAKE ERROR")}}
+			},
+		}),
+	}
+	r := mux.NewRouter()
+	srv.RegisterAt(r)
+	r.Methods("GET").Path("/metrics").Handler(metrics.Handler())
+	listener := httptest.NewServer(metrics.WrapRouter(r))
+	client := listener.Client()
+	defer listener.Close()
+
+	for _, rq := range []string{
+		"GET /v1/user/john@smith.com",
+		"GET /v1/user/john@smith.com",
+		"GET /v1/user/jane@example.com",
+		"DELETE /v1/user/jane@example.com",
+		"GET /v1/no-such-route/jane@example.com",
+	} {
+		s := strings.Split(rq, " ")
+		req, err := http.NewRequest(s[0], listener.URL+s[1], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs.Body.Close()
+	}
+
+	rs, err := client.Get(listener.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(rs.Body)
+	rs.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`users_http_requests_total{method="GET",route="/v1/user/{email}",status="200"} 2`,
+		`users_http_requests_total{method="GET",route="/v1/user/{email}",status="500"} 1`,
+		`users_http_requests_total{method="DELETE",route="/v1/user/{email}",status="404"} 1`,
+		`users_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`users_http_request_duration_seconds_count{method="GET",route="/v1/user/{email}",status="200"} 2`,
+		`users_db_operation_duration_seconds_count{operation="GetUser"} 3`,
+		`users_db_operation_errors_total{kind="other",operation="GetUser"} 1`,
+		`users_db_operation_errors_total{kind="not_found",operation="DeleteUser"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("missing metric: %s", want)
+		}
+	}
+	if strings.Contains(string(body), "@") {
+		t.Errorf("metrics contain raw email:\n%s", string(body))
+	}
+}
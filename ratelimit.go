@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RateLimit describes a token bucket: up to Requests requests can be made in a
+// burst, and the bucket is refilled continuously at the rate of Requests per
+// Period.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+func (l RateLimit) tokensPerSecond() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// RateLimitResult is the outcome of taking a token from a bucket.
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is the time after which the next token will be available.
+	// Zero if Allowed.
+	RetryAfter time.Duration
+	// Reset is the time after which the bucket will be full again.
+	Reset time.Duration
+}
+
+// RateLimitStore keeps the state of token buckets. Implementations must be
+// safe for concurrent use. An implementation backed by a shared store (e.g.
+// Redis) allows to enforce limits across multiple instances of the service.
+type RateLimitStore interface {
+	// Take tries to take a single token from the bucket identified by key.
+	Take(key string, limit RateLimit, now time.Time) RateLimitResult
+}
+
+// MemoryRateLimitStore keeps token buckets in memory of the process. Buckets
+// which got completely refilled are periodically dropped, so that memory use
+// is proportional to the number of recently active clients.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	limit   RateLimit
+	tokens  float64
+	updated time.Time
+}
+
+const rateLimitSweepInterval = time.Minute
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*tokenBucket{}}
+}
+
+func (s *MemoryRateLimitStore) Take(key string, limit RateLimit, now time.Time) RateLimitResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) >= rateLimitSweepInterval {
+		s.sweep(now)
+	}
+
+	b := s.buckets[key]
+	if b == nil || b.limit != limit {
+		b = &tokenBucket{limit: limit, tokens: float64(limit.Requests), updated: now}
+		s.buckets[key] = b
+	}
+	b.refill(now)
+
+	rate := limit.tokensPerSecond()
+	result := RateLimitResult{}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - b.tokens) / rate)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = secondsToDuration((float64(limit.Requests) - b.tokens) / rate)
+	return result
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updated)
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens = math.Min(float64(b.limit.Requests), b.tokens+elapsed.Seconds()*b.limit.tokensPerSecond())
+	b.updated = now
+}
+
+// sweep removes all buckets which are full, as they are equivalent to new ones.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Requests) {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+// secondsToDuration converts s to a Duration, rounded to microseconds to hide
+// floating point errors.
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(math.Round(s*1e6)) * time.Microsecond
+}
+
+// RateLimiter is an HTTP middleware rejecting requests of clients which
+// exceeded the limit configured for a route. Clients are identified by IP
+// address, or by the value of KeyHeader if it is set and present in the
+// request.
+type RateLimiter struct {
+	Store RateLimitStore
+	// Limits are keyed by "METHOD /path/template" of a route, e.g.
+	// "GET /v1/user/{email}". The limit under key "*" applies to all other
+	// routes. Routes without a limit are not rate limited.
+	Limits map[string]RateLimit
+	// KeyHeader is a request header identifying the client, e.g. X-API-Key.
+	// It must only be used if the header is verified upstream (e.g. by an API
+	// gateway), otherwise clients could evade the limits by changing it.
+	KeyHeader string
+
+	now func() time.Time // for tests
+}
+
+func (l *RateLimiter) WrapHTTPHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.Method + " "
+		if cur := mux.CurrentRoute(r); cur != nil {
+			tmpl, _ := cur.GetPathTemplate()
+			route += tmpl
+		}
+		limit, ok := l.Limits[route]
+		if !ok {
+			limit, ok = l.Limits["*"]
+		}
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now
+		if l.now != nil {
+			now = l.now
+		}
+		result := l.Store.Take(route+" "+clientKey(r, l.KeyHeader), limit, now())
+
+		header := w.Header()
+		header.Set("RateLimit-Limit", strconv.Itoa(limit.Requests))
+		header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+		if !result.Allowed {
+			header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			RespondError(w, http.StatusTooManyRequests, errors.New("rate limit exceeded, try again later"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// clientKey identifies the client which sent r, by the value of keyHeader if
+// it is not empty and present in the request, or by IP address otherwise.
+func clientKey(r *http.Request, keyHeader string) string {
+	if keyHeader != "" {
+		if key := r.Header.Get(keyHeader); key != "" {
+			return "key:" + key
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// ParseRateLimits parses a comma-separated list of limits in format:
+// "ROUTE=REQUESTS/PERIOD", where ROUTE is "METHOD /path/template" or "*", and
+// PERIOD is a duration like "1m" or a unit like "s", "m", "h". For example:
+//
+//	POST /v1/user=10/m,GET /v1/user/{email}=100/10s
+func ParseRateLimits(s string) (map[string]RateLimit, error) {
+	limits := map[string]RateLimit{}
+	if strings.TrimSpace(s) == "" {
+		return limits, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		eq := strings.LastIndex(entry, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("parsing rate limit %q: missing '='", entry)
+		}
+		route := strings.Join(strings.Fields(entry[:eq]), " ")
+		if route != "*" && len(strings.Fields(route)) != 2 {
+			return nil, fmt.Errorf("parsing rate limit %q: route must be '*' or 'METHOD /path'", entry)
+		}
+		slash := strings.Index(entry[eq+1:], "/")
+		if slash < 0 {
+			return nil, fmt.Errorf("parsing rate limit %q: missing '/' in REQUESTS/PERIOD", entry)
+		}
+		requests, err := strconv.Atoi(strings.TrimSpace(entry[eq+1 : eq+1+slash]))
+		if err != nil || requests <= 0 {
+			return nil, fmt.Errorf("parsing rate limit %q: number of requests must be a positive integer", entry)
+		}
+		period := strings.TrimSpace(entry[eq+1+slash+1:])
+		if period != "" && strings.IndexAny(period[:1], "0123456789") < 0 {
+			period = "1" + period
+		}
+		d, err := time.ParseDuration(period)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("parsing rate limit %q: invalid period", entry)
+		}
+		if _, dup := limits[route]; dup {
+			return nil, fmt.Errorf("parsing rate limit %q: duplicate route", entry)
+		}
+		limits[route] = RateLimit{Requests: requests, Period: d}
+	}
+	return limits, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	limit := RateLimit{Requests: 2, Period: 10 * time.Second}
+	t0 := time.Unix(1000000, 0)
+
+	for i, tt := range []struct {
+		at         time.Duration
+		key        string
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+	}{
+		{0, "a", true, 1, 0},
+		{0, "a", true, 0, 0},
+		{0, "a", false, 0, 5 * time.Second},
+		{0, "b", true, 1, 0},
+		{2 * time.Second, "a", false, 0, 3 * time.Second},
+		{5 * time.Second, "a", true, 0, 0},
+		{time.Hour, "a", true, 1, 0},
+	} {
+		have := store.Take(tt.key, limit, t0.Add(tt.at))
+		if have.Allowed != tt.allowed || have.Remaining != tt.remaining || have.RetryAfter != tt.retryAfter {
+			t.Errorf("#%d: want allowed=%v remaining=%d retryAfter=%s, have %+v",
+				i, tt.allowed, tt.remaining, tt.retryAfter, have)
+		}
+	}
+
+	// Full buckets are dropped
+	store.Take("c", limit, t0.Add(2*time.Hour))
+	if len(store.buckets) != 1 {
+		t.Errorf("want only 1 bucket after sweep, have %d", len(store.buckets))
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	limiter := &RateLimiter{
+		Store: NewMemoryRateLimitStore(),
+		Limits: map[string]RateLimit{
+			"POST /v1/user": {Requests: 1, Period: time.Minute},
+		},
+		KeyHeader: "X-API-Key",
+		now:       func() time.Time { return now },
+	}
+	r := mux.NewRouter()
+	r.Use(limiter.WrapHTTPHandler)
+	srv := Server{DB: nullDB{}}
+	srv.RegisterAt(r)
+
+	do := func(method, path, remoteAddr, apiKey string) *httptest.ResponseRecorder {
+		rq := httptest.NewRequest(method, path, nil)
+		rq.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			rq.Header.Set("X-API-Key", apiKey)
+		}
+		rs := httptest.NewRecorder()
+		r.ServeHTTP(rs, rq)
+		return rs
+	}
+
+	rs := do("POST", "/v1/user", "10.0.0.1:1234", "")
+	if rs.Code == http.StatusTooManyRequests {
+		t.Fatalf("first request: unexpected %d", rs.Code)
+	}
+	if rs.Header().Get("RateLimit-Limit") != "1" || rs.Header().Get("RateLimit-Remaining") != "0" || rs.Header().Get("RateLimit-Reset") != "60" {
+		t.Errorf("first request: unexpected headers %v", rs.Header())
+	}
+
+	rs = do("POST", "/v1/user", "10.0.0.1:5678", "")
+	if rs.Code != http.StatusTooManyRequests {
+		t.Errorf("second request: want %d, have %d", http.StatusTooManyRequests, rs.Code)
+	}
+	if rs.Header().Get("Retry-After") != "60" {
+		t.Errorf("second request: want Retry-After 60, have %q", rs.Header().Get("Retry-After"))
+	}
+
+	if rs := do("POST", "/v1/user", "10.0.0.2:1234", ""); rs.Code == http.StatusTooManyRequests {
+		t.Errorf("other IP: unexpected %d", rs.Code)
+	}
+	if rs := do("POST", "/v1/user", "10.0.0.1:1234", "secret"); rs.Code == http.StatusTooManyRequests {
+		t.Errorf("API key: unexpected %d", rs.Code)
+	}
+	if rs := do("GET", "/v1/user", "10.0.0.1:1234", ""); rs.Code == http.StatusTooManyRequests || rs.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("unlimited route: unexpected %d %v", rs.Code, rs.Header())
+	}
+
+	now = now.Add(time.Minute)
+	if rs := do("POST", "/v1/user", "10.0.0.1:1234", ""); rs.Code == http.StatusTooManyRequests {
+		t.Errorf("after refill: unexpected %d", rs.Code)
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits("POST /v1/user=10/m, GET  /v1/user/{email}=100/10s,*=1000/h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]RateLimit{
+		"POST /v1/user":        {10, time.Minute},
+		"GET /v1/user/{email}": {100, 10 * time.Second},
+		"*":                    {1000, time.Hour},
+	}
+	if len(limits) != len(want) {
+		t.Errorf("want %v, have %v", want, limits)
+	}
+	for k, v := range want {
+		if limits[k] != v {
+			t.Errorf("%q: want %v, have %v", k, v, limits[k])
+		}
+	}
+
+	for _, bad := range []string{"/v1/user=10/m", "*=10", "*=0/m", "*=10/x", "*=1/m,*=2/m"} {
+		if _, err := ParseRateLimits(bad); err == nil {
+			t.Errorf("%q: want error", bad)
+		}
+	}
+}
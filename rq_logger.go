@@ -1,39 +1,272 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
-	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
+// RequestLogger writes an access log entry, formatted as a single line of
+// JSON, for every HTTP request handled.
 type RequestLogger struct {
-	w *log.Logger
+	emails   EmailLogMode
+	emailKey []byte             // for EmailsHashed
+	file     *lumberjack.Logger // nil in tests
+
+	mu sync.Mutex // guards w
+	w  io.Writer
+}
+
+// LogRotation describes when a log file should be rotated, and how many of
+// the old files should be kept.
+type LogRotation struct {
+	// MaxSizeMB is the size in megabytes at which the file is rotated.
+	// Default is 100 MB.
+	MaxSizeMB int
+	// Interval is the period after which the file is rotated regardless of
+	// its size. Zero disables time-based rotation.
+	Interval time.Duration
+	// MaxBackups is the maximum number of old files kept. Zero keeps all.
+	MaxBackups int
+	// MaxAge is the maximum age of old files kept (rounded up to full days).
+	// Zero keeps all.
+	MaxAge time.Duration
+	// Compress enables gzip compression of old files.
+	Compress bool
 }
 
-// TODO: rand.Seed(...) to ensure request IDs are unique
+// EmailLogMode specifies how email addresses found in request URLs are
+// written to the access log.
+type EmailLogMode string
 
-const RequestIDHeader = "X-Homework-Request-ID"
+const (
+	// EmailsRedacted replaces email addresses with a fixed placeholder.
+	EmailsRedacted EmailLogMode = "redact"
+	// EmailsHashed replaces email addresses with an HMAC-SHA256 keyed with a
+	// secret, allowing to correlate requests about the same user without
+	// storing the address. Without the key, the hashes cannot be reversed by
+	// hashing known addresses.
+	EmailsHashed EmailLogMode = "hash"
+)
 
-func NewRequestLogger(filename string) (*RequestLogger, error) {
+// NewRequestLogger creates a RequestLogger writing to the specified file. The
+// emailKey is the secret used with EmailsHashed, and is required for it.
+func NewRequestLogger(filename string, emails EmailLogMode, emailKey string, rotation LogRotation) (*RequestLogger, error) {
+	if emails != EmailsRedacted && emails != EmailsHashed {
+		return nil, fmt.Errorf("creating request logger: unsupported email log mode %q, must be one of: redact hash", emails)
+	}
+	if emails == EmailsHashed && emailKey == "" {
+		return nil, fmt.Errorf("creating request logger: email log mode %q requires a key", emails)
+	}
+	// Fail early if the file cannot be written; lumberjack would only
+	// report it on first write
 	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("creating request logger: %w", err)
 	}
+	f.Close()
 
-	w := log.New(f, "", log.Ldate|log.Ltime)
-	return &RequestLogger{w}, nil
+	file := &lumberjack.Logger{
+		Filename:   filename,
+		MaxSize:    rotation.MaxSizeMB,
+		MaxBackups: rotation.MaxBackups,
+		MaxAge:     int((rotation.MaxAge + 24*time.Hour - 1) / (24 * time.Hour)),
+		Compress:   rotation.Compress,
+	}
+	l := &RequestLogger{emails: emails, emailKey: []byte(emailKey), file: file, w: file}
+	if rotation.Interval > 0 {
+		go l.rotateEvery(rotation.Interval)
+	}
+	return l, nil
+}
+
+func (l *RequestLogger) rotateEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.mu.Lock()
+		err := l.file.Rotate()
+		l.mu.Unlock()
+		if err != nil {
+			log.Printf("ERROR: rotating access log: %s", err)
+		}
+	}
+}
+
+// ReopenOnSIGHUP starts a goroutine closing the log file every time the
+// process receives the SIGHUP signal; the file is reopened (or recreated) by
+// name on the next write. This allows external tools like logrotate to move
+// the file away.
+func (l *RequestLogger) ReopenOnSIGHUP() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			l.mu.Lock()
+			err := l.file.Close()
+			l.mu.Unlock()
+			if err != nil {
+				log.Printf("ERROR: reopening access log on SIGHUP: %s", err)
+			}
+		}
+	}()
+}
+
+// Close closes the log file.
+func (l *RequestLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// accessLogEntry describes the JSON structure of an access log line.
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	TraceID    string    `json:"trace_id,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Query      string    `json:"query,omitempty"`
+	Route      string    `json:"route,omitempty"`
+	Status     int       `json:"status"`
+	DurationMS float64   `json:"duration_ms"`
+	Bytes      int64     `json:"bytes"`
+	RemoteAddr string    `json:"remote_addr"`
+	UserAgent  string    `json:"user_agent,omitempty"`
 }
 
 func (l *RequestLogger) WrapHTTPHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		rqID := rand.Uint64()
-		r.Header.Set(RequestIDHeader, fmt.Sprint(rqID))
+		start := time.Now()
 
-		// TODO: also log r.Method ?
-		l.w.Printf("%v %s", rqID, r.URL)
+		// Honor request ID provided by the caller, to allow correlating logs
+		// across services
+		rqID := r.Header.Get(RequestIDHeader)
+		if !validRequestID(rqID) {
+			rqID = newRequestID()
+			r.Header.Set(RequestIDHeader, rqID)
+		}
+		w.Header().Set(RequestIDHeader, rqID)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("request_id", rqID))
 
-		h.ServeHTTP(w, r)
+		rec := &responseRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r.WithContext(WithRequestID(r.Context(), rqID)))
+
+		entry := accessLogEntry{
+			Time:       start.UTC(),
+			RequestID:  rqID,
+			TraceID:    traceIDFromContext(r.Context()),
+			Method:     r.Method,
+			Path:       l.redactPath(r.URL.EscapedPath()),
+			Query:      l.redactQuery(r.URL.RawQuery),
+			Status:     rec.Status(),
+			DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+			Bytes:      rec.bytes,
+			RemoteAddr: r.RemoteAddr,
+			UserAgent:  r.UserAgent(),
+		}
+		if cur := mux.CurrentRoute(r); cur != nil {
+			entry.Route, _ = cur.GetPathTemplate()
+		}
+		l.write(&entry)
 	})
 }
+
+func (l *RequestLogger) write(entry *accessLogEntry) {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("BUG: cannot marshal access log entry: %s", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(append(buf, '\n'))
+	if err != nil {
+		log.Printf("ERROR: writing access log: %s", err)
+	}
+}
+
+// redactPath replaces all segments of an escaped URL path which contain an
+// email address.
+func (l *RequestLogger) redactPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		unescaped, err := url.PathUnescape(s)
+		if err != nil {
+			unescaped = s
+		}
+		if strings.Contains(unescaped, "@") {
+			segments[i] = l.redactEmail(unescaped)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// sensitiveQueryParams lists URL query parameters whose values are secret,
+// e.g. email verification tokens (see EmailVerifier), or personal data used
+// in user filters (see NewUserFilter), and are always redacted.
+var sensitiveQueryParams = map[string]bool{
+	"token": true,
+	"phone": true,
+	"city":  true,
+}
+
+// sensitiveQueryParamPrefix is the prefix of metadata filter parameters,
+// which are always redacted, as metadata may contain personal data.
+const sensitiveQueryParamPrefix = "metadata."
+
+// redactQuery replaces all values of a raw URL query which contain an email
+// address, or are sensitive (see sensitiveQueryParams). Unparseable queries
+// are dropped altogether.
+func (l *RequestLogger) redactQuery(rawQuery string) string {
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "<unparseable>"
+	}
+	redacted := false
+	for key, values := range query {
+		for i, v := range values {
+			switch {
+			case sensitiveQueryParams[strings.ToLower(key)],
+				strings.HasPrefix(strings.ToLower(key), sensitiveQueryParamPrefix):
+				values[i] = "<redacted>"
+			case strings.Contains(v, "@"):
+				values[i] = l.redactEmail(v)
+			default:
+				continue
+			}
+			redacted = true
+		}
+	}
+	if !redacted {
+		return rawQuery
+	}
+	return query.Encode()
+}
+
+func (l *RequestLogger) redactEmail(email string) string {
+	if l.emails == EmailsHashed {
+		mac := hmac.New(sha256.New, l.emailKey)
+		mac.Write([]byte(email))
+		return "hmac:" + hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	return "<redacted>"
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRequestLogger(t *testing.T) {
+	tests := []struct {
+		comment   string
+		emails    EmailLogMode
+		rq        string
+		wantPath  string
+		wantQuery string
+	}{
+		{
+			comment:  "email in path is redacted",
+			emails:   EmailsRedacted,
+			rq:       "GET /v1/user/john@smith.com",
+			wantPath: "/v1/user/<redacted>",
+		},
+		{
+			comment:  "escaped email in path is redacted",
+			emails:   EmailsRedacted,
+			rq:       "GET /v1/user/john%40smith.com",
+			wantPath: "/v1/user/<redacted>",
+		},
+		{
+			comment:  "email in path is hashed",
+			emails:   EmailsHashed,
+			rq:       "DELETE /v1/user/john@smith.com",
+			wantPath: "/v1/user/hmac:",
+		},
+		{
+			comment:   "query without emails is kept",
+			emails:    EmailsRedacted,
+			rq:        "GET /v1/user?technology=go",
+			wantPath:  "/v1/user",
+			wantQuery: "technology=go",
+		},
+		{
+			comment:   "email in query is redacted",
+			emails:    EmailsRedacted,
+			rq:        "GET /v1/user?technology=go&x=john@smith.com",
+			wantPath:  "/v1/user",
+			wantQuery: "technology=go&x=%3Credacted%3E",
+		},
+		{
+			comment:   "verification token is redacted",
+			emails:    EmailsHashed,
+			rq:        "GET /v1/users/verify-email?token=6ba7b810-9dad-11d1-80b4-00c04fd430c8.1600003600.c2lnbmF0dXJl",
+			wantPath:  "/v1/users/verify-email",
+			wantQuery: "token=%3Credacted%3E",
+		},
+		{
+			comment:   "personal data in filters is redacted",
+			emails:    EmailsRedacted,
+			rq:        "GET /v1/user?phone=%2B48123456789&city=Johnstown&metadata.nick=johnny&country=PL",
+			wantPath:  "/v1/user",
+			wantQuery: "city=%3Credacted%3E&country=PL&metadata.nick=%3Credacted%3E&phone=%3Credacted%3E",
+		},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		logger := &RequestLogger{emails: tt.emails, emailKey: []byte("secret"), w: &buf}
+		r := mux.NewRouter()
+		r.Use(logger.WrapHTTPHandler)
+		r.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("hello"))
+		})
+
+		s := strings.Split(tt.rq, " ")
+		rq := httptest.NewRequest(s[0], s[1], nil)
+		rq.Header.Set("User-Agent", "test-agent")
+		r.ServeHTTP(httptest.NewRecorder(), rq)
+
+		if strings.Contains(buf.String(), "john") || strings.Contains(buf.String(), "c2lnbmF0dXJl") {
+			t.Errorf("%q: log contains secrets:\n%s", tt.comment, buf.String())
+		}
+		var entry accessLogEntry
+		err := json.Unmarshal(buf.Bytes(), &entry)
+		if err != nil {
+			t.Errorf("%q: cannot parse log line: %s\n%s", tt.comment, err, buf.String())
+			continue
+		}
+		if !strings.HasPrefix(entry.Path, tt.wantPath) {
+			t.Errorf("%q: want path %q, have %q", tt.comment, tt.wantPath, entry.Path)
+		}
+		if entry.Query != tt.wantQuery {
+			t.Errorf("%q: want query %q, have %q", tt.comment, tt.wantQuery, entry.Query)
+		}
+		if entry.Method != s[0] || entry.Status != http.StatusCreated || entry.Bytes != 5 ||
+			entry.UserAgent != "test-agent" || entry.RemoteAddr == "" || entry.RequestID == "" || entry.Route != "/" {
+			t.Errorf("%q: bad log entry: %s", tt.comment, buf.String())
+		}
+	}
+}
+
+func TestRequestLogger_RequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &RequestLogger{emails: EmailsRedacted, w: &buf}
+	var gotID string
+	h := logger.WrapHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotID = RequestIDFromContext(r.Context())
+	}))
+
+	// Incoming valid ID is honored
+	rq := httptest.NewRequest("GET", "/v1/user", nil)
+	rq.Header.Set(RequestIDHeader, "upstream-42")
+	rs := httptest.NewRecorder()
+	h.ServeHTTP(rs, rq)
+	if gotID != "upstream-42" || rs.Header().Get(RequestIDHeader) != "upstream-42" {
+		t.Errorf("incoming ID not honored: context %q, response %q", gotID, rs.Header().Get(RequestIDHeader))
+	}
+
+	// Invalid ID is replaced
+	rq = httptest.NewRequest("GET", "/v1/user", nil)
+	rq.Header.Set(RequestIDHeader, "*/ evil")
+	rs = httptest.NewRecorder()
+	h.ServeHTTP(rs, rq)
+	if gotID == "*/ evil" || len(gotID) != 32 || rs.Header().Get(RequestIDHeader) != gotID {
+		t.Errorf("invalid ID not replaced: context %q, response %q", gotID, rs.Header().Get(RequestIDHeader))
+	}
+}
+
+func TestRequestLogger_Reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rq_logger_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "requests.log")
+
+	logger, err := NewRequestLogger(filename, EmailsRedacted, "", LogRotation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	h := logger.WrapHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/first", nil))
+	// Simulate logrotate moving the file away, then sending SIGHUP
+	err = os.Rename(filename, filename+".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.mu.Lock()
+	logger.file.Close()
+	logger.mu.Unlock()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/second", nil))
+
+	old, err := ioutil.ReadFile(filename + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(old), "/first") || strings.Contains(string(old), "/second") {
+		t.Errorf("bad rotated file contents:\n%s", old)
+	}
+	if !strings.Contains(string(current), "/second") || strings.Contains(string(current), "/first") {
+		t.Errorf("bad reopened file contents:\n%s", current)
+	}
+}
+
+func TestRequestLogger_HashedEmailKey(t *testing.T) {
+	a := &RequestLogger{emails: EmailsHashed, emailKey: []byte("key A")}
+	b := &RequestLogger{emails: EmailsHashed, emailKey: []byte("key B")}
+	if a.redactEmail("john@smith.com") != a.redactEmail("john@smith.com") {
+		t.Errorf("hash is not stable")
+	}
+	if a.redactEmail("john@smith.com") == b.redactEmail("john@smith.com") {
+		t.Errorf("hash does not depend on the key")
+	}
+
+	_, err := NewRequestLogger(filepath.Join(os.TempDir(), "unused.log"), EmailsHashed, "", LogRotation{})
+	if err == nil {
+		t.Errorf("want error for hashing without a key")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
@@ -10,6 +11,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -22,7 +24,19 @@ const validJohnSmith = `
 "password": "some pwd",
 "birthday": "1950-01-01T00:00:00Z",
 "address": "Some Street 17\nSome City",
-"phone": "111 222 333",
+"phone": "600 123 456",
+"technology": "go"
+}
+`
+
+const validJohnSmithNoPhone = `
+{
+"email": "john@smith.com",
+"name": "John",
+"surname": "Smith",
+"password": "some pwd",
+"birthday": "1950-01-01T00:00:00Z",
+"address": "Some Street 17\nSome City",
 "technology": "go"
 }
 `
@@ -47,6 +61,30 @@ func TestServer_PostAndPutUser_Validation(t *testing.T) {
 			rq:         `hello world!`,
 			wantStatus: http.StatusBadRequest,
 		},
+		{
+			comment:   "unknown field",
+			endpoints: defaultEndpoints,
+			rq: `
+{
+"emial": "john@smith.com",
+"name": "John",
+"surname": "Smith",
+"password": "some pwd",
+"birthday": "1950-01-01T00:00:00Z",
+"address": "Some Street 17\nSome City",
+"technology": "go"
+}
+`,
+			wantStatus:    http.StatusBadRequest,
+			wantReplyWith: "emial",
+		},
+		{
+			comment:       "trailing data after JSON object",
+			endpoints:     defaultEndpoints,
+			rq:            validJohnSmith + `{}`,
+			wantStatus:    http.StatusBadRequest,
+			wantReplyWith: "after JSON",
+		},
 		// Incorrect field values
 		{
 			comment:   "invalid User: invalid email (no @)",
@@ -59,7 +97,7 @@ func TestServer_PostAndPutUser_Validation(t *testing.T) {
 "password": "some pwd",
 "birthday": "1950-01-01T00:00:00Z",
 "address": "Some Street 17\nSome City",
-"phone": "111 222 333",
+"phone": "600 123 456",
 "technology": "go"
 }
 `,
@@ -77,7 +115,7 @@ func TestServer_PostAndPutUser_Validation(t *testing.T) {
 "password": "some pwd",
 "birthday": "1950-01-01T00:00:00Z",
 "address": "Some Street 17\nSome City",
-"phone": "111 222 333",
+"phone": "600 123 456",
 "technology": "haskell"
 }
 `,
@@ -95,7 +133,7 @@ func TestServer_PostAndPutUser_Validation(t *testing.T) {
 "password": "some pwd",
 "birthday": "1950-01-01T00:00:00Z",
 "address": "Some Street 17\nSome City",
-"phone": "111 222 333",
+"phone": "600 123 456",
 "technology": "go",
 "deleted": "1950-01-01T00:00:00Z"
 }
@@ -112,6 +150,41 @@ func TestServer_PostAndPutUser_Validation(t *testing.T) {
 			wantStatus:    http.StatusBadRequest,
 			wantReplyWith: "email",
 		},
+		{
+			comment:       "invalid User: invalid .phone",
+			endpoints:     defaultEndpoints,
+			rq:            strings.Replace(validJohnSmith, "600 123 456", "call me", 1),
+			wantStatus:    http.StatusBadRequest,
+			wantReplyWith: "phone",
+		},
+		{
+			comment:       "invalid User: .phone not existing in region",
+			endpoints:     defaultEndpoints,
+			rq:            strings.Replace(validJohnSmith, "600 123 456", "111 222 333", 1),
+			wantStatus:    http.StatusBadRequest,
+			wantReplyWith: "phone",
+		},
+		{
+			comment:       "invalid User: invalid .address.postal_code",
+			endpoints:     defaultEndpoints,
+			rq:            strings.Replace(validJohnSmith, `"Some Street 17\nSome City"`, `{"lines": ["Some Street 17"], "city": "Some City", "postal_code": "12345", "country": "PL"}`, 1),
+			wantStatus:    http.StatusBadRequest,
+			wantReplyWith: "postal_code",
+		},
+		{
+			comment:       "invalid User: unknown field in .address",
+			endpoints:     defaultEndpoints,
+			rq:            strings.Replace(validJohnSmith, `"Some Street 17\nSome City"`, `{"lines": ["Some Street 17"], "town": "Some City", "country": "PL"}`, 1),
+			wantStatus:    http.StatusBadRequest,
+			wantReplyWith: "town",
+		},
+		{
+			comment:       "invalid User: invalid .metadata key",
+			endpoints:     defaultEndpoints,
+			rq:            strings.Replace(validJohnSmith, `"technology": "go"`, `"technology": "go", "metadata": {"a b": 1}`, 1),
+			wantStatus:    http.StatusBadRequest,
+			wantReplyWith: "metadata",
+		},
 		// Missing fields
 		{
 			comment:   "invalid User: no email",
@@ -123,7 +196,7 @@ func TestServer_PostAndPutUser_Validation(t *testing.T) {
 "password": "some pwd",
 "birthday": "1950-01-01T00:00:00Z",
 "address": "Some Street 17\nSome City",
-"phone": "111 222 333",
+"phone": "600 123 456",
 "technology": "go"
 }
 `,
@@ -140,7 +213,7 @@ func TestServer_PostAndPutUser_Validation(t *testing.T) {
 "password": "some pwd",
 "birthday": "1950-01-01T00:00:00Z",
 "address": "Some Street 17\nSome City",
-"phone": "111 222 333",
+"phone": "600 123 456",
 "technology": "go"
 }
 `,
@@ -157,7 +230,7 @@ func TestServer_PostAndPutUser_Validation(t *testing.T) {
 "password": "some pwd",
 "birthday": "1950-01-01T00:00:00Z",
 "address": "Some Street 17\nSome City",
-"phone": "111 222 333",
+"phone": "600 123 456",
 "technology": "go"
 }
 `,
@@ -174,7 +247,7 @@ func TestServer_PostAndPutUser_Validation(t *testing.T) {
 "surname": "Smith",
 "birthday": "1950-01-01T00:00:00Z",
 "address": "Some Street 17\nSome City",
-"phone": "111 222 333",
+"phone": "600 123 456",
 "technology": "go"
 }
 `,
@@ -191,7 +264,7 @@ func TestServer_PostAndPutUser_Validation(t *testing.T) {
 "surname": "Smith",
 "password": "some pwd",
 "address": "Some Street 17\nSome City",
-"phone": "111 222 333",
+"phone": "600 123 456",
 "technology": "go"
 }
 `,
@@ -208,7 +281,7 @@ func TestServer_PostAndPutUser_Validation(t *testing.T) {
 "surname": "Smith",
 "password": "some pwd",
 "birthday": "1950-01-01T00:00:00Z",
-"phone": "111 222 333",
+"phone": "600 123 456",
 "technology": "go"
 }
 `,
@@ -226,34 +299,88 @@ func TestServer_PostAndPutUser_Validation(t *testing.T) {
 "password": "some pwd",
 "birthday": "1950-01-01T00:00:00Z",
 "address": "Some Street 17\nSome City",
-"phone": "111 222 333"
+"phone": "600 123 456"
 }
 `,
 			wantStatus:    http.StatusBadRequest,
 			wantReplyWith: "technology",
 		},
+		{
+			comment:       "invalid User: .technology not in .technologies",
+			endpoints:     defaultEndpoints,
+			rq:            strings.Replace(validJohnSmith, `"technology": "go"`, `"technology": "go", "technologies": [{"name": "java"}]`, 1),
+			wantStatus:    http.StatusBadRequest,
+			wantReplyWith: "technologies",
+		},
+		{
+			comment:       "invalid User: duplicated .technologies",
+			endpoints:     defaultEndpoints,
+			rq:            strings.Replace(validJohnSmith, `"technology": "go"`, `"technologies": [{"name": "go"}, {"name": "go"}]`, 1),
+			wantStatus:    http.StatusBadRequest,
+			wantReplyWith: "duplicated",
+		},
+		{
+			comment:       "invalid User: invalid value in .technologies",
+			endpoints:     defaultEndpoints,
+			rq:            strings.Replace(validJohnSmith, `"technology": "go"`, `"technologies": [{"name": "go"}, {"name": "haskell"}]`, 1),
+			wantStatus:    http.StatusBadRequest,
+			wantReplyWith: "technologies[1]",
+		},
+		{
+			comment:       "invalid User: invalid .technologies level",
+			endpoints:     defaultEndpoints,
+			rq:            strings.Replace(validJohnSmith, `"technology": "go"`, `"technologies": [{"name": "go", "level": "guru"}]`, 1),
+			wantStatus:    http.StatusBadRequest,
+			wantReplyWith: "level",
+		},
 
 		// VALID REQUESTS
 		{
 			comment:    "correct User, with optional .phone present",
-			endpoints:  defaultEndpoints,
+			endpoints:  []string{"POST /v1/user"},
+			rq:         validJohnSmith,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			comment:    "correct User, with optional .phone present",
+			endpoints:  []string{"PUT /v1/user/john@smith.com"},
 			rq:         validJohnSmith,
 			wantStatus: http.StatusNoContent,
 		},
 		{
-			comment:   "correct User, with optional .phone absent",
-			endpoints: defaultEndpoints,
-			rq: `
-{
-"email": "john@smith.com",
-"name": "John",
-"surname": "Smith",
-"password": "some pwd",
-"birthday": "1950-01-01T00:00:00Z",
-"address": "Some Street 17\nSome City",
-"technology": "go"
-}
-`,
+			comment:    "correct User, with optional .phone absent",
+			endpoints:  []string{"POST /v1/user"},
+			rq:         validJohnSmithNoPhone,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			comment:    "correct User, with optional .phone absent",
+			endpoints:  []string{"PUT /v1/user/john@smith.com"},
+			rq:         validJohnSmithNoPhone,
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			comment:    "correct User, with structured .address",
+			endpoints:  []string{"POST /v1/user"},
+			rq:         strings.Replace(validJohnSmith, `"Some Street 17\nSome City"`, `{"lines": ["Some Street 17"], "city": "Some City", "postal_code": "00-950", "country": "PL"}`, 1),
+			wantStatus: http.StatusCreated,
+		},
+		{
+			comment:    "correct User, with .metadata",
+			endpoints:  []string{"POST /v1/user"},
+			rq:         strings.Replace(validJohnSmith, `"technology": "go"`, `"technology": "go", "metadata": {"team": "core", "employee_number": 17}`, 1),
+			wantStatus: http.StatusCreated,
+		},
+		{
+			comment:    "correct User, with .technologies instead of .technology",
+			endpoints:  []string{"POST /v1/user"},
+			rq:         strings.Replace(validJohnSmith, `"technology": "go"`, `"technologies": [{"name": "go", "level": "expert", "since": "2015-06-01T00:00:00Z"}, {"name": "js"}]`, 1),
+			wantStatus: http.StatusCreated,
+		},
+		{
+			comment:    "correct User, with .technologies instead of .technology",
+			endpoints:  []string{"PUT /v1/user/john@smith.com"},
+			rq:         strings.Replace(validJohnSmith, `"technology": "go"`, `"technologies": [{"name": "go", "level": "expert", "since": "2015-06-01T00:00:00Z"}, {"name": "js"}]`, 1),
 			wantStatus: http.StatusNoContent,
 		},
 	}
@@ -300,41 +427,167 @@ func TestServer_PostAndPutUser_Validation(t *testing.T) {
 	}
 }
 
+func TestServer_PostAndPutUser_BodyChecks(t *testing.T) {
+	srv := Server{DB: nullDB{}, MaxBodyBytes: 512}
+	r := mux.NewRouter()
+	srv.RegisterAt(r)
+
+	tests := []struct {
+		comment     string
+		contentType string
+		body        string
+		wantStatus  int // 0 means any successful status
+	}{
+		{"missing Content-Type", "", validJohnSmith, http.StatusUnsupportedMediaType},
+		{"wrong Content-Type", "text/plain", validJohnSmith, http.StatusUnsupportedMediaType},
+		{"Content-Type with charset", "application/json; charset=utf-8", validJohnSmith, 0},
+		{"too long body", "application/json", validJohnSmith + strings.Repeat(" ", 512), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		for _, e := range []string{"POST /v1/user", "PUT /v1/user/john@smith.com"} {
+			s := strings.Split(e, " ")
+			rq := httptest.NewRequest(s[0], s[1], strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				rq.Header.Set("Content-Type", tt.contentType)
+			}
+			rs := httptest.NewRecorder()
+			r.ServeHTTP(rs, rq)
+			if rs.Code != tt.wantStatus && (tt.wantStatus != 0 || rs.Code >= 300) {
+				t.Errorf("%s %q: want status %d, have %d: %s", e, tt.comment, tt.wantStatus, rs.Code, rs.Body.String())
+			}
+		}
+	}
+}
+
 func TestServer_PostUser_LocationHeader(t *testing.T) {
-	// Prepare server
-	srv := Server{
-		DB:      nullDB{},
-		BaseURL: "TEST",
+	tests := []struct {
+		comment      string
+		baseURL      string
+		header       http.Header
+		email        string
+		wantLocation string
+	}{
+		{
+			comment:      "configured base URL",
+			baseURL:      "https://api.example.com/users/",
+			header:       http.Header{"X-Forwarded-Host": {"evil.example.com"}},
+			email:        "john@smith.com",
+			wantLocation: "https://api.example.com/users/v1/user/john@smith.com",
+		},
+		{
+			comment:      "derived from Host",
+			email:        "john@smith.com",
+			wantLocation: "http://example.com/v1/user/john@smith.com",
+		},
+		{
+			comment: "derived from X-Forwarded-* headers",
+			header: http.Header{
+				"X-Forwarded-Host":  {"api.example.com, proxy.local"},
+				"X-Forwarded-Proto": {"https"},
+			},
+			email:        "john@smith.com",
+			wantLocation: "https://api.example.com/v1/user/john@smith.com",
+		},
+		{
+			comment:      "email escaped",
+			baseURL:      "TEST",
+			email:        "jo/hn?x#y@smith.com",
+			wantLocation: "TEST/v1/user/jo%2Fhn%3Fx%23y@smith.com",
+		},
 	}
+
+	for _, tt := range tests {
+		srv := Server{
+			DB:      nullDB{},
+			BaseURL: tt.baseURL,
+		}
+		r := mux.NewRouter()
+		srv.RegisterAt(r)
+
+		body := strings.Replace(validJohnSmith, "john@smith.com", tt.email, 1)
+		rq := httptest.NewRequest("POST", "http://example.com/v1/user", strings.NewReader(body))
+		for k, v := range tt.header {
+			rq.Header[k] = v
+		}
+		rq.Header.Set("Content-Type", "application/json")
+		rs := httptest.NewRecorder()
+		r.ServeHTTP(rs, rq)
+
+		if rs.Code != http.StatusCreated {
+			t.Errorf("%q: want status %d, have %d: %s", tt.comment, http.StatusCreated, rs.Code, rs.Body.String())
+		}
+		if location := rs.Header().Get("Location"); location != tt.wantLocation {
+			t.Errorf("%q: bad Location:\nwant: %q\nhave: %q", tt.comment, tt.wantLocation, location)
+		}
+	}
+}
+
+func TestServer_PostUser_ResponseBody(t *testing.T) {
+	srv := Server{DB: nullDB{}}
 	r := mux.NewRouter()
 	srv.RegisterAt(r)
-	listener := httptest.NewServer(r)
-	client := listener.Client()
-	defer listener.Close()
+	rq := httptest.NewRequest("POST", "/v1/user", strings.NewReader(validJohnSmith))
+	rq.Header.Set("Content-Type", "application/json")
+	rs := httptest.NewRecorder()
+	r.ServeHTTP(rs, rq)
 
-	// RUN TEST
-	rs, err := client.Post(listener.URL+"/v1/user", "application/json", strings.NewReader(validJohnSmith))
+	var have map[string]interface{}
+	err := json.Unmarshal(rs.Body.Bytes(), &have)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("unmarshalling response: %s, in:\n%s", err, rs.Body.String())
 	}
-	defer rs.Body.Close()
-
-	// Verify 'Location' header in HTTP response
-	wantLocation := "TEST/v1/user/john@smith.com"
-	location := rs.Header.Get("Location")
-	if location != wantLocation {
-		t.Errorf("bad Location:\nwant: %q\nhave: %q", wantLocation, location)
+	if have["email"] != "john@smith.com" || have["name"] != "John" {
+		t.Errorf("response does not contain created user: %s", rs.Body.String())
+	}
+	if _, found := have["password"]; found {
+		t.Errorf("response contains password: %s", rs.Body.String())
 	}
 }
 
 type nullDB struct{}
 
-func (db nullDB) ListUsers(filter UserFilter) ([]*User, error) { return nil, nil }
-func (db nullDB) GetUser(email string) (*User, error)          { return nil, nil }
-func (db nullDB) CreateUser(u *User) error                     { return nil }
-func (db nullDB) ModifyUser(u *User) error                     { return nil }
-func (db nullDB) DeleteUser(email string) error                { return nil }
-func (db nullDB) Close() error                                 { return nil }
+func (db nullDB) ListUsers(_ context.Context, filter UserFilter) ([]*User, error) { return nil, nil }
+func (db nullDB) GetUser(_ context.Context, email string) (*User, error)          { return nil, nil }
+func (db nullDB) CreateUser(_ context.Context, u *User) error                     { return nil }
+func (db nullDB) ModifyUser(_ context.Context, u *User) error                     { return nil }
+func (db nullDB) DeleteUser(_ context.Context, email string) error                { return nil }
+func (db nullDB) GetUserAsOf(_ context.Context, email string, at time.Time) (*User, error) {
+	return nil, nil
+}
+func (db nullDB) GetUserByID(_ context.Context, id string) (*User, error)       { return nil, nil }
+func (db nullDB) ModifyUserByID(_ context.Context, id string, u *User) error    { return nil }
+func (db nullDB) DeleteUserByID(_ context.Context, id string) error             { return nil }
+func (db nullDB) VerifyUserEmail(_ context.Context, id, emailNorm string) error { return nil }
+func (db nullDB) RestoreUserByID(_ context.Context, id string) error            { return nil }
+func (db nullDB) ListUserEvents(_ context.Context, after int64, limit int) ([]*UserEvent, error) {
+	return nil, nil
+}
+func (db nullDB) ListTechnologies(_ context.Context) ([]*Technology, error)         { return nil, nil }
+func (db nullDB) CreateTechnology(_ context.Context, t *Technology) error           { return nil }
+func (db nullDB) ModifyTechnology(_ context.Context, t *Technology) error           { return nil }
+func (db nullDB) DeleteTechnology(_ context.Context, name string) error             { return nil }
+func (db nullDB) ListGroups(_ context.Context) ([]*Group, error)                    { return nil, nil }
+func (db nullDB) GetGroup(_ context.Context, name string) (*Group, error)           { return nil, nil }
+func (db nullDB) CreateGroup(_ context.Context, g *Group) error                     { return nil }
+func (db nullDB) ModifyGroup(_ context.Context, g *Group) error                     { return nil }
+func (db nullDB) DeleteGroup(_ context.Context, name string) error                  { return nil }
+func (db nullDB) AddGroupMember(_ context.Context, group, userID string) error      { return nil }
+func (db nullDB) RemoveGroupMember(_ context.Context, group, userID string) error   { return nil }
+func (db nullDB) ListUserGroups(_ context.Context, userID string) ([]*Group, error) { return nil, nil }
+func (db nullDB) ListWebhooks(_ context.Context) ([]*Webhook, error)                { return nil, nil }
+func (db nullDB) GetWebhook(_ context.Context, id string) (*Webhook, error)         { return nil, nil }
+func (db nullDB) CreateWebhook(_ context.Context, h *Webhook) error                 { return nil }
+func (db nullDB) ModifyWebhook(_ context.Context, h *Webhook) error                 { return nil }
+func (db nullDB) DeleteWebhook(_ context.Context, id string) error                  { return nil }
+func (db nullDB) ListWebhookDeliveries(_ context.Context, webhookID, state string) ([]*WebhookDelivery, error) {
+	return nil, nil
+}
+func (db nullDB) RetryWebhookDelivery(_ context.Context, webhookID string, id int64) error {
+	return nil
+}
+func (db nullDB) Ping(_ context.Context) error                     { return nil }
+func (db nullDB) PendingMigrations(_ context.Context) (int, error) { return 0, nil }
+func (db nullDB) Close() error                                     { return nil }
 
 func TestServer_ListUsers(t *testing.T) {
 	tests := []struct {
@@ -402,6 +655,149 @@ func TestServer_ListUsers(t *testing.T) {
 			query:      "?technology=FOOBAR&deleted=yes",
 			wantStatus: http.StatusBadRequest,
 		},
+		{
+			query: "?phone=600%20123%20456",
+			wantFilter: &UserFilter{
+				Deleted: newBool(false),
+				Phone:   newString("+48600123456"),
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			query:      "?phone=call%20me",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			query: "?technologies=go,js",
+			wantFilter: &UserFilter{
+				Deleted:      newBool(false),
+				Technologies: []string{"go", "js"},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			query: "?technologies=go,js&match=all&min_level=advanced",
+			wantFilter: &UserFilter{
+				Deleted:         newBool(false),
+				Technologies:    []string{"go", "js"},
+				AllTechnologies: true,
+				MinLevel:        ProficiencyAdvanced,
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			query: "?technologies=go,js,go&match=all",
+			wantFilter: &UserFilter{
+				Deleted:         newBool(false),
+				Technologies:    []string{"go", "js"},
+				AllTechnologies: true,
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			query:      "?technologies=go,FOOBAR",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			query:      "?technologies=go&match=some",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			query:      "?technologies=go&min_level=guru",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			query:      "?min_level=expert",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			query: "?country=gb&city=London",
+			wantFilter: &UserFilter{
+				Deleted: newBool(false),
+				Country: newString("GB"),
+				City:    newString("London"),
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			query:      "?country=UK",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			query: "?metadata.team=core&metadata.employee_number=17",
+			wantFilter: &UserFilter{
+				Deleted:  newBool(false),
+				Metadata: map[string][]string{"team": {"core"}, "employee_number": {"17"}},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			query: "?metadata.team=core&metadata.team=web",
+			wantFilter: &UserFilter{
+				Deleted:  newBool(false),
+				Metadata: map[string][]string{"team": {"core", "web"}},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			query:      "?metadata.a%20b=1",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			query: "?group=core",
+			wantFilter: &UserFilter{
+				Deleted: newBool(false),
+				Group:   newString("core"),
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			query:      "?group=Core%20Team",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			query: "?verified=no",
+			wantFilter: &UserFilter{
+				Deleted:  newBool(false),
+				Verified: newBool(false),
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			query: "?verified=true",
+			wantFilter: &UserFilter{
+				Deleted:  newBool(false),
+				Verified: newBool(true),
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			query:      "?verified=pending",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			query: "?as_of=2020-03-01T12:00:00Z&deleted=*",
+			wantFilter: &UserFilter{
+				AsOf: newTime(time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)),
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			query: "?as_of=2020-03-01",
+			wantFilter: &UserFilter{
+				Deleted: newBool(false),
+				AsOf:    newTime(time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)),
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			query:      "?as_of=yesterday",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			query:      "?as_of=2020-03-01&group=core",
+			wantStatus: http.StatusBadRequest,
+		},
 	}
 
 	for _, tt := range tests {
@@ -445,20 +841,114 @@ func TestServer_ListUsers(t *testing.T) {
 }
 
 type callbackDB struct {
-	listUsers  func(filter UserFilter) ([]*User, error)
-	getUser    func(email string) (*User, error)
-	createUser func(u *User) error
-	modifyUser func(u *User) error
-	deleteUser func(email string) error
-	close      func() error
+	listUsers         func(filter UserFilter) ([]*User, error)
+	getUser           func(email string) (*User, error)
+	createUser        func(u *User) error
+	modifyUser        func(u *User) error
+	deleteUser        func(email string) error
+	getUserAsOf       func(email string, at time.Time) (*User, error)
+	getUserByID       func(id string) (*User, error)
+	modifyUserByID    func(id string, u *User) error
+	deleteUserByID    func(id string) error
+	verifyUserEmail   func(id, emailNorm string) error
+	restoreUserByID   func(id string) error
+	listUserEvents    func(after int64, limit int) ([]*UserEvent, error)
+	listTechnologies  func() ([]*Technology, error)
+	createTechnology  func(t *Technology) error
+	modifyTechnology  func(t *Technology) error
+	deleteTechnology  func(name string) error
+	listGroups        func() ([]*Group, error)
+	getGroup          func(name string) (*Group, error)
+	createGroup       func(g *Group) error
+	modifyGroup       func(g *Group) error
+	deleteGroup       func(name string) error
+	addGroupMember    func(group, userID string) error
+	removeGroupMember func(group, userID string) error
+	listUserGroups    func(userID string) ([]*Group, error)
+	listWebhooks      func() ([]*Webhook, error)
+	getWebhook        func(id string) (*Webhook, error)
+	createWebhook     func(h *Webhook) error
+	modifyWebhook     func(h *Webhook) error
+	deleteWebhook     func(id string) error
+	listDeliveries    func(webhookID, state string) ([]*WebhookDelivery, error)
+	retryDelivery     func(webhookID string, id int64) error
+	ping              func() error
+	pending           func() (int, error)
+	close             func() error
 }
 
-func (db callbackDB) ListUsers(filter UserFilter) ([]*User, error) { return db.listUsers(filter) }
-func (db callbackDB) GetUser(email string) (*User, error)          { return db.getUser(email) }
-func (db callbackDB) CreateUser(u *User) error                     { return db.createUser(u) }
-func (db callbackDB) ModifyUser(u *User) error                     { return db.modifyUser(u) }
-func (db callbackDB) DeleteUser(email string) error                { return db.deleteUser(email) }
-func (db callbackDB) Close() error                                 { return db.close() }
+func (db callbackDB) ListUsers(_ context.Context, filter UserFilter) ([]*User, error) {
+	return db.listUsers(filter)
+}
+func (db callbackDB) GetUser(_ context.Context, email string) (*User, error) {
+	return db.getUser(email)
+}
+func (db callbackDB) CreateUser(_ context.Context, u *User) error      { return db.createUser(u) }
+func (db callbackDB) ModifyUser(_ context.Context, u *User) error      { return db.modifyUser(u) }
+func (db callbackDB) DeleteUser(_ context.Context, email string) error { return db.deleteUser(email) }
+func (db callbackDB) GetUserAsOf(_ context.Context, email string, at time.Time) (*User, error) {
+	return db.getUserAsOf(email, at)
+}
+func (db callbackDB) GetUserByID(_ context.Context, id string) (*User, error) {
+	return db.getUserByID(id)
+}
+func (db callbackDB) ModifyUserByID(_ context.Context, id string, u *User) error {
+	return db.modifyUserByID(id, u)
+}
+func (db callbackDB) DeleteUserByID(_ context.Context, id string) error { return db.deleteUserByID(id) }
+func (db callbackDB) VerifyUserEmail(_ context.Context, id, emailNorm string) error {
+	return db.verifyUserEmail(id, emailNorm)
+}
+func (db callbackDB) RestoreUserByID(_ context.Context, id string) error {
+	return db.restoreUserByID(id)
+}
+func (db callbackDB) ListUserEvents(_ context.Context, after int64, limit int) ([]*UserEvent, error) {
+	return db.listUserEvents(after, limit)
+}
+func (db callbackDB) ListTechnologies(_ context.Context) ([]*Technology, error) {
+	return db.listTechnologies()
+}
+func (db callbackDB) CreateTechnology(_ context.Context, t *Technology) error {
+	return db.createTechnology(t)
+}
+func (db callbackDB) ModifyTechnology(_ context.Context, t *Technology) error {
+	return db.modifyTechnology(t)
+}
+func (db callbackDB) DeleteTechnology(_ context.Context, name string) error {
+	return db.deleteTechnology(name)
+}
+func (db callbackDB) ListGroups(_ context.Context) ([]*Group, error) { return db.listGroups() }
+func (db callbackDB) GetGroup(_ context.Context, name string) (*Group, error) {
+	return db.getGroup(name)
+}
+func (db callbackDB) CreateGroup(_ context.Context, g *Group) error    { return db.createGroup(g) }
+func (db callbackDB) ModifyGroup(_ context.Context, g *Group) error    { return db.modifyGroup(g) }
+func (db callbackDB) DeleteGroup(_ context.Context, name string) error { return db.deleteGroup(name) }
+func (db callbackDB) AddGroupMember(_ context.Context, group, userID string) error {
+	return db.addGroupMember(group, userID)
+}
+func (db callbackDB) RemoveGroupMember(_ context.Context, group, userID string) error {
+	return db.removeGroupMember(group, userID)
+}
+func (db callbackDB) ListUserGroups(_ context.Context, userID string) ([]*Group, error) {
+	return db.listUserGroups(userID)
+}
+func (db callbackDB) ListWebhooks(_ context.Context) ([]*Webhook, error) { return db.listWebhooks() }
+func (db callbackDB) GetWebhook(_ context.Context, id string) (*Webhook, error) {
+	return db.getWebhook(id)
+}
+func (db callbackDB) CreateWebhook(_ context.Context, h *Webhook) error { return db.createWebhook(h) }
+func (db callbackDB) ModifyWebhook(_ context.Context, h *Webhook) error { return db.modifyWebhook(h) }
+func (db callbackDB) DeleteWebhook(_ context.Context, id string) error  { return db.deleteWebhook(id) }
+func (db callbackDB) ListWebhookDeliveries(_ context.Context, webhookID, state string) ([]*WebhookDelivery, error) {
+	return db.listDeliveries(webhookID, state)
+}
+func (db callbackDB) RetryWebhookDelivery(_ context.Context, webhookID string, id int64) error {
+	return db.retryDelivery(webhookID, id)
+}
+func (db callbackDB) Ping(_ context.Context) error                     { return db.ping() }
+func (db callbackDB) PendingMigrations(_ context.Context) (int, error) { return db.pending() }
+func (db callbackDB) Close() error                                     { return db.close() }
 
 func dumpJSON(v interface{}) string {
 	buf, _ := json.Marshal(v)
@@ -677,3 +1167,352 @@ func TestServer_VariousErrors(t *testing.T) {
 		listener.Close()
 	}
 }
+
+func TestServer_Health(t *testing.T) {
+	tests := []struct {
+		comment    string
+		path       string
+		db         callbackDB
+		shutdown   bool
+		wantStatus int
+	}{
+		{
+			comment:    "liveness does not check database",
+			path:       "/healthz",
+			db:         callbackDB{},
+			wantStatus: http.StatusOK,
+		},
+		{
+			comment: "ready",
+			path:    "/readyz",
+			db: callbackDB{
+				ping:    func() error { return nil },
+				pending: func() (int, error) { return 0, nil },
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			comment: "database unreachable",
+			path:    "/readyz",
+			db: callbackDB{
+				ping:    func() error { return errors.New("FAKE ERROR") },
+				pending: func() (int, error) { return 0, errors.New("FAKE ERROR") },
+			},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			comment: "migrations pending",
+			path:    "/readyz",
+			db: callbackDB{
+				ping:    func() error { return nil },
+				pending: func() (int, error) { return 1, nil },
+			},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			comment: "shutting down",
+			path:    "/readyz",
+			db: callbackDB{
+				ping:    func() error { return nil },
+				pending: func() (int, error) { return 0, nil },
+			},
+			shutdown:   true,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		srv := Server{DB: tt.db}
+		if tt.shutdown {
+			srv.StartShutdown()
+		}
+		r := mux.NewRouter()
+		srv.RegisterAt(r)
+		listener := httptest.NewServer(r)
+		client := listener.Client()
+
+		rs, err := client.Get(listener.URL + tt.path)
+		listener.Close()
+		if err != nil {
+			t.Errorf("%q: HTTP request error: %s", tt.comment, err)
+			continue
+		}
+		rs.Body.Close()
+		if rs.StatusCode != tt.wantStatus {
+			t.Errorf("%q: want status %v, got %v (%v)", tt.comment, tt.wantStatus, rs.StatusCode, rs.Status)
+		}
+	}
+}
+
+func TestServer_UserByID(t *testing.T) {
+	const id = "0b8e2a8e-4c4a-4f8e-9d55-6a3d1c9f1e2b"
+	tests := []struct {
+		comment    string
+		rq         string // "METHOD URL[ BODY]"
+		db         callbackDB
+		wantStatus int
+	}{
+		{
+			comment: "get existing user",
+			rq:      `GET /v1/users/by-id/` + id,
+			db: callbackDB{
+				getUserByID: func(have string) (*User, error) {
+					if have != id {
+						return nil, nil
+					}
+					return &User{PublicID: id, Email: newString("john@smith.com")}, nil
+				},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			comment:    "get with malformed ID",
+			rq:         `GET /v1/users/by-id/john@smith.com`,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			comment: "modify, changing email",
+			rq:      `PUT /v1/users/by-id/` + id + ` ` + validJohnSmith,
+			db: callbackDB{
+				modifyUserByID: func(have string, u *User) error {
+					if have != id {
+						return ErrNotFound{wraperr{errors.New("FAKE ERROR")}}
+					}
+					return nil
+				},
+			},
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			comment:    "modify with mismatched .id",
+			rq:         `PUT /v1/users/by-id/` + id + ` ` + strings.Replace(validJohnSmith, "{", `{"id": "`+newPublicID()+`",`, 1),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			comment: "modify by email with matching .id",
+			rq:      `PUT /v1/user/john@smith.com ` + strings.Replace(validJohnSmith, "{", `{"id": "`+id+`",`, 1),
+			db: callbackDB{
+				getUser: func(email string) (*User, error) {
+					return &User{PublicID: id, Email: newString(email)}, nil
+				},
+				modifyUser: func(_ *User) error { return nil },
+			},
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			comment: "modify by email with mismatched .id",
+			rq:      `PUT /v1/user/john@smith.com ` + strings.Replace(validJohnSmith, "{", `{"id": "`+newPublicID()+`",`, 1),
+			db: callbackDB{
+				getUser: func(email string) (*User, error) {
+					return &User{PublicID: id, Email: newString(email)}, nil
+				},
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			comment: "modify to email of another user",
+			rq:      `PUT /v1/users/by-id/` + id + ` ` + validJohnSmith,
+			db: callbackDB{
+				modifyUserByID: func(_ string, _ *User) error {
+					return ErrConflict{wraperr{errors.New("FAKE ERROR")}}
+				},
+			},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			comment: "delete missing user",
+			rq:      `DELETE /v1/users/by-id/` + id,
+			db: callbackDB{
+				deleteUserByID: func(_ string) error {
+					return ErrNotFound{wraperr{errors.New("FAKE ERROR")}}
+				},
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			comment:    "create with .id",
+			rq:         `POST /v1/user ` + strings.Replace(validJohnSmith, "{", `{"id": "`+id+`",`, 1),
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		srv := Server{DB: tt.db}
+		r := mux.NewRouter()
+		srv.RegisterAt(r)
+
+		query := strings.SplitN(tt.rq, " ", 3)
+		var body io.Reader
+		if len(query) >= 3 {
+			body = strings.NewReader(query[2])
+		}
+		rq := httptest.NewRequest(query[0], query[1], body)
+		rq.Header.Set("Content-Type", "application/json")
+		rs := httptest.NewRecorder()
+		r.ServeHTTP(rs, rq)
+
+		if rs.Code != tt.wantStatus {
+			t.Errorf("%q: want status %v, got %v: %s", tt.comment, tt.wantStatus, rs.Code, rs.Body.String())
+		}
+	}
+}
+
+func TestNewPublicID(t *testing.T) {
+	id := newPublicID()
+	if !validPublicID(id) {
+		t.Errorf("invalid ID generated: %q", id)
+	}
+	if id[14] != '4' {
+		t.Errorf("want version 4 UUID, have %q", id)
+	}
+	if id == newPublicID() {
+		t.Errorf("IDs not random")
+	}
+	for _, bad := range []string{"", "john@smith.com", strings.ToUpper(id), id + "0", "0b8e2a8e04c4a-4f8e-9d55-6a3d1c9f1e2b"} {
+		if validPublicID(bad) {
+			t.Errorf("%q: want invalid", bad)
+		}
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	for _, tt := range []struct{ email, want string }{
+		{"john@smith.com", "john@smith.com"},
+		{"  Jane@Example.COM\n", "jane@example.com"},
+		{"Jan@Zażółć.PL", "jan@xn--za-6ja4f8n1l.pl"},
+		{"a@b@example.com", "a@b@example.com"},
+	} {
+		have, err := NormalizeEmail(tt.email)
+		if err != nil || have != tt.want {
+			t.Errorf("%q: want %q, have %q, %v", tt.email, tt.want, have, err)
+		}
+	}
+	for _, bad := range []string{"john.smith.com", "@example.com", "john@", "john@exa mple.com"} {
+		if have, err := NormalizeEmail(bad); err == nil {
+			t.Errorf("%q: want error, have %q", bad, have)
+		}
+	}
+}
+
+func TestServer_PutUser_EmailCaseInsensitive(t *testing.T) {
+	var modified *User
+	srv := Server{DB: callbackDB{
+		modifyUser: func(u *User) error {
+			modified = u
+			return nil
+		},
+	}}
+	r := mux.NewRouter()
+	srv.RegisterAt(r)
+
+	body := strings.Replace(validJohnSmith, `"john@smith.com"`, `" John@Smith.com "`, 1)
+	rq := httptest.NewRequest("PUT", "/v1/user/JOHN@smith.COM", strings.NewReader(body))
+	rq.Header.Set("Content-Type", "application/json")
+	rs := httptest.NewRecorder()
+	r.ServeHTTP(rs, rq)
+
+	if rs.Code != http.StatusNoContent {
+		t.Fatalf("want status %d, have %d: %s", http.StatusNoContent, rs.Code, rs.Body.String())
+	}
+	if *modified.Email != "John@Smith.com" || modified.EmailNorm != "john@smith.com" {
+		t.Errorf("want display email %q and normalized %q, have %q and %q",
+			"John@Smith.com", "john@smith.com", *modified.Email, modified.EmailNorm)
+	}
+}
+
+func TestNormalizePhone(t *testing.T) {
+	for _, tt := range []struct{ phone, want string }{
+		{"600 123 456", "+48600123456"},
+		{"+48 22 123-45-67", "+48221234567"},
+		{"(0048) 600123456", "+48600123456"},
+		{"+1 415 555 2671", "+14155552671"},
+	} {
+		have, err := NormalizePhone(tt.phone)
+		if err != nil || have != tt.want {
+			t.Errorf("%q: want %q, have %q, %v", tt.phone, tt.want, have, err)
+		}
+	}
+	for _, bad := range []string{"call me", "111 222 333", "+999 123 456 789", "12"} {
+		if have, err := NormalizePhone(bad); err == nil {
+			t.Errorf("%q: want error, have %q", bad, have)
+		}
+	}
+}
+
+func TestUser_Validate_Technologies(t *testing.T) {
+	var u User
+	err := json.Unmarshal([]byte(validJohnSmith), &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = u.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []UserTechnology{{Name: "go"}}; !reflect.DeepEqual(u.Technologies, want) {
+		t.Errorf("from .technology: want .technologies %v, have %v", want, u.Technologies)
+	}
+
+	u.Technology = nil
+	u.Technologies = []UserTechnology{{Name: "js", Level: ProficiencyExpert}, {Name: "go"}}
+	err = u.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Technology == nil || *u.Technology != "js" {
+		t.Errorf("from .technologies: want .technology js, have %v", u.Technology)
+	}
+
+	buf, err := json.Marshal(u.Technologies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[{"name":"js","level":"expert"},{"name":"go"}]`; string(buf) != want {
+		t.Errorf("want JSON %s, have %s", want, buf)
+	}
+}
+
+func TestServer_GetUser_AsOf(t *testing.T) {
+	var gotAt time.Time
+	srv := Server{
+		DB: callbackDB{
+			getUserAsOf: func(email string, at time.Time) (*User, error) {
+				gotAt = at
+				if email != "jane@example.com" {
+					return nil, nil
+				}
+				return &User{Email: newString(email), Name: newString("Jane")}, nil
+			},
+			getUser: func(email string) (*User, error) {
+				t.Errorf("unexpected GetUser(%q)", email)
+				return nil, nil
+			},
+		},
+	}
+	r := mux.NewRouter()
+	srv.RegisterAt(r)
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantAt     time.Time
+	}{
+		{"/v1/user/jane@example.com?as_of=2020-03-01", http.StatusOK, time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"/v1/user/jane@example.com?as_of=2020-03-01T12:30:00%2B01:00", http.StatusOK, time.Date(2020, 3, 1, 11, 30, 0, 0, time.UTC)},
+		{"/v1/user/john@smith.com?as_of=2020-03-01", http.StatusNotFound, time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"/v1/user/jane@example.com?as_of=March", http.StatusBadRequest, time.Time{}},
+	}
+	for _, tt := range tests {
+		gotAt = time.Time{}
+		rs := httptest.NewRecorder()
+		r.ServeHTTP(rs, httptest.NewRequest("GET", tt.path, nil))
+		if rs.Code != tt.wantStatus {
+			t.Errorf("%s: want status %d, have %d: %s", tt.path, tt.wantStatus, rs.Code, rs.Body.String())
+		}
+		if !gotAt.Equal(tt.wantAt) {
+			t.Errorf("%s: want as of %s, have %s", tt.path, tt.wantAt, gotAt)
+		}
+	}
+}
+
+func newTime(t time.Time) *time.Time { return &t }
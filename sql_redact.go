@@ -0,0 +1,295 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// sensitiveColumns lists database columns holding personal data, whose values
+// must not be written into logs.
+var sensitiveColumns = map[string]bool{
+	"name":       true,
+	"surname":    true,
+	"email":      true,
+	"email_norm": true,
+	"metadata":   true,
+	"password":   true,
+	"birthday":   true,
+	"address":    true,
+	"phone":      true,
+	// user_events.data holds a copy of a User
+	"data": true,
+	// webhooks.secret signs deliveries
+	"secret": true,
+}
+
+const redactedLiteral = "'[redacted]'"
+
+// sqlToken is a lexical token of an SQL query, as far as is needed for
+// redacting values.
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+}
+
+type sqlTokenKind int
+
+const (
+	sqlSpace  sqlTokenKind = iota // whitespace & comments
+	sqlWord                       // keywords, bare identifiers
+	sqlIdent                      // "quoted identifiers"
+	sqlString                     // 'string literals', E'...'
+	sqlNumber
+	sqlPunct
+)
+
+func tokenizeSQL(query string) []sqlToken {
+	var tokens []sqlToken
+	for i := 0; i < len(query); {
+		c := query[i]
+		start := i
+		var kind sqlTokenKind
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			for i < len(query) && strings.IndexByte(" \t\n\r", query[i]) >= 0 {
+				i++
+			}
+			kind = sqlSpace
+		case strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			i += end
+			kind = sqlSpace
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += 2 + end + 2
+			}
+			kind = sqlSpace
+		case c == '\'' || ((c == 'E' || c == 'e') && i+1 < len(query) && query[i+1] == '\''):
+			if c != '\'' {
+				i++
+			}
+			i = skipQuoted(query, i, '\'')
+			kind = sqlString
+		case c == '"':
+			i = skipQuoted(query, i, '"')
+			kind = sqlIdent
+		case c >= '0' && c <= '9':
+			for i < len(query) && (query[i] >= '0' && query[i] <= '9' || query[i] == '.' || query[i] == 'e' || query[i] == 'E') {
+				i++
+			}
+			kind = sqlNumber
+		case c == '_' || c >= 0x80 || unicode.IsLetter(rune(c)):
+			for i < len(query) && (query[i] == '_' || query[i] == '$' || query[i] >= 0x80 ||
+				unicode.IsLetter(rune(query[i])) || unicode.IsDigit(rune(query[i]))) {
+				i++
+			}
+			kind = sqlWord
+		case strings.HasPrefix(query[i:], "->") || strings.HasPrefix(query[i:], "#>"):
+			// JSON field access: ->, ->>, #>, #>>
+			i += 2
+			if i < len(query) && query[i] == '>' {
+				i++
+			}
+			kind = sqlPunct
+		default:
+			// Keep multi-character operators together, e.g. <>, !=, ::, @>
+			i++
+			for i < len(query) && strings.IndexByte("<>=!:~@", query[i]) >= 0 && strings.IndexByte("<>=!:~@", c) >= 0 {
+				i++
+			}
+			kind = sqlPunct
+		}
+		tokens = append(tokens, sqlToken{kind, query[start:i]})
+	}
+	return tokens
+}
+
+// skipQuoted returns the index just past a quoted token starting at query[i],
+// taking doubled quotes and backslash escapes into account.
+func skipQuoted(query string, i int, quote byte) int {
+	for i++; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if quote == '\'' {
+				i++
+			}
+		case quote:
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(query)
+}
+
+// columnName returns the unquoted, lowercase column name if t is an
+// identifier token, or an empty string otherwise.
+func (t sqlToken) columnName() string {
+	switch t.kind {
+	case sqlIdent:
+		return strings.ToLower(strings.Replace(t.text[1:len(t.text)-1], `""`, `"`, -1))
+	case sqlWord:
+		return strings.ToLower(t.text)
+	default:
+		return ""
+	}
+}
+
+func (t sqlToken) isLiteral() bool {
+	return t.kind == sqlString || t.kind == sqlNumber
+}
+
+func (t sqlToken) isJSONAccess() bool {
+	return t.kind == sqlPunct && (t.text == "->" || t.text == "->>" || t.text == "#>" || t.text == "#>>")
+}
+
+// redactSQL replaces values of sensitive columns in a formatted SQL query with
+// a placeholder. It recognizes comparisons and assignments like
+// "column" = 'value' (also with IN lists and LIKE), also when the column is
+// accessed as JSON (column->>'key') or wrapped in a function call
+// (lower(column) = lower('value')), and values in INSERT INTO ... (columns)
+// VALUES (...) statements.
+//
+// The redaction is best-effort: it is intended for logging queries built by
+// this service, not arbitrary SQL.
+func redactSQL(query string, sensitive map[string]bool) string {
+	tokens := tokenizeSQL(query)
+
+	// significant returns index of the next non-space token at or after i
+	significant := func(i int) int {
+		for i < len(tokens) && tokens[i].kind == sqlSpace {
+			i++
+		}
+		return i
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+
+		// INSERT INTO table (col, ...) VALUES (val, ...), ...
+		if t.kind == sqlWord && strings.EqualFold(t.text, "INSERT") {
+			i = redactInsert(tokens, i, sensitive, significant)
+			continue
+		}
+
+		// column <op> literal
+		if col := t.columnName(); col == "" || !sensitive[col] {
+			continue
+		}
+		j := significant(i + 1)
+		// Skip JSON field access, e.g.: column->>'key'
+		for j < len(tokens) && tokens[j].isJSONAccess() {
+			j = significant(significant(j+1) + 1)
+		}
+		// Skip closing parens of functions wrapping the column, e.g.:
+		// lower(column)
+		for j < len(tokens) && tokens[j].text == ")" {
+			j = significant(j + 1)
+		}
+		if j >= len(tokens) {
+			break
+		}
+		op := tokens[j]
+		isOp := op.kind == sqlPunct && (op.text == "=" || op.text == "<>" || op.text == "!=" ||
+			op.text == "<" || op.text == ">" || op.text == "<=" || op.text == ">=" || op.text == "@>")
+		isWordOp := op.kind == sqlWord && (strings.EqualFold(op.text, "LIKE") || strings.EqualFold(op.text, "ILIKE") || strings.EqualFold(op.text, "IN"))
+		if !isOp && !isWordOp {
+			continue
+		}
+		k := significant(j + 1)
+		if k >= len(tokens) {
+			break
+		}
+		if tokens[k].kind == sqlWord {
+			// Function call, e.g.: lower(literal)
+			if l := significant(k + 1); l < len(tokens) && tokens[l].text == "(" {
+				k = l
+			}
+		}
+		if tokens[k].kind == sqlPunct && tokens[k].text == "(" {
+			// IN (literal, ...), or function arguments
+			for depth := 0; k < len(tokens); k++ {
+				switch {
+				case tokens[k].text == "(":
+					depth++
+				case tokens[k].text == ")":
+					depth--
+				case tokens[k].isLiteral():
+					tokens[k].text = redactedLiteral
+				}
+				if depth == 0 {
+					break
+				}
+			}
+		} else if tokens[k].isLiteral() {
+			tokens[k].text = redactedLiteral
+		}
+		i = k
+	}
+
+	var b strings.Builder
+	for _, t := range tokens {
+		b.WriteString(t.text)
+	}
+	return b.String()
+}
+
+// redactInsert processes tokens of an INSERT statement starting at index i,
+// and returns the index of the last processed token.
+func redactInsert(tokens []sqlToken, i int, sensitive map[string]bool, significant func(int) int) int {
+	// Find the column list: first "(" after INSERT
+	j := i + 1
+	for j < len(tokens) && tokens[j].text != "(" {
+		if tokens[j].kind == sqlWord && (strings.EqualFold(tokens[j].text, "VALUES") || strings.EqualFold(tokens[j].text, "SELECT")) {
+			return i
+		}
+		j++
+	}
+	var columns []string
+	for j++; j < len(tokens) && tokens[j].text != ")"; j++ {
+		if name := tokens[j].columnName(); name != "" {
+			columns = append(columns, name)
+		}
+	}
+	j = significant(j + 1)
+	if j >= len(tokens) || !strings.EqualFold(tokens[j].text, "VALUES") {
+		return j
+	}
+
+	// Process each tuple of values
+	for {
+		j = significant(j + 1)
+		if j >= len(tokens) || tokens[j].text != "(" {
+			return j - 1
+		}
+		column, depth := 0, 0
+		for ; j < len(tokens); j++ {
+			t := &tokens[j]
+			switch {
+			case t.text == "(":
+				depth++
+			case t.text == ")":
+				depth--
+			case t.text == "," && depth == 1:
+				column++
+			case t.isLiteral() && column < len(columns) && sensitive[columns[column]]:
+				t.text = redactedLiteral
+			}
+			if depth == 0 {
+				break
+			}
+		}
+		j = significant(j + 1)
+		if j >= len(tokens) || tokens[j].text != "," {
+			return j - 1
+		}
+	}
+}
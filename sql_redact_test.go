@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestRedactSQL(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{
+			`SELECT "user"."id", "user"."email" FROM "users" AS "user" WHERE (email = 'john@smith.com') AND (deleted IS NULL)`,
+			`SELECT "user"."id", "user"."email" FROM "users" AS "user" WHERE (email = '[redacted]') AND (deleted IS NULL)`,
+		},
+		{
+			`SELECT * FROM users WHERE (technology = 'go') AND ("user"."email" IN ('a@b.c', 'd@e.f'))`,
+			`SELECT * FROM users WHERE (technology = 'go') AND ("user"."email" IN ('[redacted]', '[redacted]'))`,
+		},
+		{
+			`INSERT INTO "users" AS "user" ("id", "name", "email", "password", "birthday", "phone", "technology") VALUES (DEFAULT, 'O''Brien', 'john@smith.com', 'pwd', '1950-01-01 00:00:00+00:00:00', NULL, 'go') RETURNING "id"`,
+			`INSERT INTO "users" AS "user" ("id", "name", "email", "password", "birthday", "phone", "technology") VALUES (DEFAULT, '[redacted]', '[redacted]', '[redacted]', '[redacted]', NULL, 'go') RETURNING "id"`,
+		},
+		{
+			`INSERT INTO t (name, x) VALUES ('a', 1), ('b', lower('c'))`,
+			`INSERT INTO t (name, x) VALUES ('[redacted]', 1), ('[redacted]', lower('c'))`,
+		},
+		{
+			`UPDATE "users" AS "user" SET "name" = 'Jane', "address" = E'Fluffy\nStreet', "technology" = 'js', "deleted" = NULL WHERE (email = 'jane@example.com')`,
+			`UPDATE "users" AS "user" SET "name" = '[redacted]', "address" = '[redacted]', "technology" = 'js', "deleted" = NULL WHERE (email = '[redacted]')`,
+		},
+		{
+			`/* request_id=abc */ SELECT 1 WHERE phone LIKE '%123%'`,
+			`/* request_id=abc */ SELECT 1 WHERE phone LIKE '[redacted]'`,
+		},
+		{
+			`SELECT * FROM users WHERE (metadata @> '{"team":"core"}')`,
+			`SELECT * FROM users WHERE (metadata @> '[redacted]')`,
+		},
+		{
+			`INSERT INTO user_events ("id", "type", "user_id", "time", "data") VALUES (DEFAULT, 'user.created', '6ba7b810-9dad-11d1-80b4-00c04fd430c8', DEFAULT, '{"name":"Jane"}') RETURNING "id", "time"`,
+			`INSERT INTO user_events ("id", "type", "user_id", "time", "data") VALUES (DEFAULT, 'user.created', '6ba7b810-9dad-11d1-80b4-00c04fd430c8', DEFAULT, '[redacted]') RETURNING "id", "time"`,
+		},
+		{
+			// Country & city filters of ListUsers
+			`SELECT "user"."id", "user"."address" FROM "users" AS "user" WHERE (address->>'country' = 'GB') AND (lower(address->>'city') = lower('London')) AND (deleted IS NULL)`,
+			`SELECT "user"."id", "user"."address" FROM "users" AS "user" WHERE (address->>'country' = '[redacted]') AND (lower(address->>'city') = lower('[redacted]')) AND (deleted IS NULL)`,
+		},
+		{
+			`SELECT * FROM users WHERE (address #>> '{lines,0}' LIKE 'Main%') AND (lower(technology) = lower('Go'))`,
+			`SELECT * FROM users WHERE (address #>> '{lines,0}' LIKE '[redacted]') AND (lower(technology) = lower('Go'))`,
+		},
+		{
+			`SELECT coalesce(max(version), 0) FROM schema_migrations`,
+			`SELECT coalesce(max(version), 0) FROM schema_migrations`,
+		},
+	}
+	for _, tt := range tests {
+		have := redactSQL(tt.query, sensitiveColumns)
+		if have != tt.want {
+			t.Errorf("bad redaction of:\n%s\nwant:\n%s\nhave:\n%s", tt.query, tt.want, have)
+		}
+	}
+}
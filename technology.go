@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Technology is an entry of the catalog of technologies which can be assigned
+// to a User.
+type Technology struct {
+	Name        string `json:"name" pg:",pk"`
+	Description string `json:"description" pg:",use_zero"`
+}
+
+// Validate checks if the Technology can be stored in the catalog.
+func (t *Technology) Validate() error {
+	if len(t.Name) == 0 || len(t.Name) > 32 {
+		return errors.New(".name must be between 1 and 32 characters long")
+	}
+	for _, c := range t.Name {
+		switch {
+		case 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+		case strings.ContainsRune("+#.-_", c):
+		default:
+			return errors.New(".name may only contain lowercase letters, digits, and: + # . - _")
+		}
+	}
+	return nil
+}
+
+// TechnologyCatalog is a cached set of names of valid technologies. It is safe
+// for concurrent use.
+type TechnologyCatalog struct {
+	mu    sync.RWMutex
+	names map[string]bool
+}
+
+// technologies is the catalog used for validating User objects and filters.
+// It starts with a built-in list, and is replaced with contents of the
+// database when connected (see PostgresDB.WatchTechnologies).
+var technologies = NewTechnologyCatalog("go", "java", "js", "php")
+
+func NewTechnologyCatalog(names ...string) *TechnologyCatalog {
+	c := &TechnologyCatalog{}
+	c.Set(names)
+	return c
+}
+
+// Valid returns true if name is in the catalog.
+func (c *TechnologyCatalog) Valid(name string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.names[name]
+}
+
+// Names returns a sorted list of technologies in the catalog.
+func (c *TechnologyCatalog) Names() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	names := make([]string, 0, len(c.names))
+	for name := range c.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Set replaces the contents of the catalog.
+func (c *TechnologyCatalog) Set(names []string) {
+	m := make(map[string]bool, len(names))
+	for _, name := range names {
+		m[name] = true
+	}
+	c.mu.Lock()
+	c.names = m
+	c.mu.Unlock()
+}
+
+// Add adds a name to the catalog.
+func (c *TechnologyCatalog) Add(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.names[name] = true
+}
+
+// Remove removes a name from the catalog.
+func (c *TechnologyCatalog) Remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.names, name)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTechnologyCatalog(t *testing.T) {
+	c := NewTechnologyCatalog("java", "go")
+	if !c.Valid("go") || c.Valid("rust") {
+		t.Errorf("unexpected contents: %v", c.Names())
+	}
+	c.Add("rust")
+	c.Remove("java")
+	if want := []string{"go", "rust"}; !reflect.DeepEqual(c.Names(), want) {
+		t.Errorf("want %v, have %v", want, c.Names())
+	}
+	c.Set([]string{"php"})
+	if want := []string{"php"}; !reflect.DeepEqual(c.Names(), want) {
+		t.Errorf("want %v, have %v", want, c.Names())
+	}
+}
+
+func TestServer_AdminTechnologies(t *testing.T) {
+	defer technologies.Set(technologies.Names())
+
+	var deleted []string
+	srv := Server{
+		DB: callbackDB{
+			createTechnology: func(t *Technology) error {
+				if t.Name == "go" {
+					return ErrConflict{wraperr{errors.New("FAKE ERROR")}}
+				}
+				return nil
+			},
+			deleteTechnology: func(name string) error {
+				if name == "java" {
+					return ErrConflict{wraperr{errors.New("FAKE ERROR")}}
+				}
+				deleted = append(deleted, name)
+				return nil
+			},
+		},
+		AdminToken: "s3cret",
+	}
+	r := mux.NewRouter()
+	srv.RegisterAt(r)
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		rq := httptest.NewRequest(method, path, strings.NewReader(body))
+		rq.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			rq.Header.Set("Authorization", "Bearer "+token)
+		}
+		rs := httptest.NewRecorder()
+		r.ServeHTTP(rs, rq)
+		return rs
+	}
+
+	tests := []struct {
+		comment    string
+		method     string
+		path       string
+		token      string
+		body       string
+		wantStatus int
+	}{
+		{"no token", "POST", "/v1/admin/technologies", "", `{"name": "rust"}`, http.StatusUnauthorized},
+		{"bad token", "POST", "/v1/admin/technologies", "guess", `{"name": "rust"}`, http.StatusUnauthorized},
+		{"invalid name", "POST", "/v1/admin/technologies", "s3cret", `{"name": "Rust Lang"}`, http.StatusBadRequest},
+		{"duplicate", "POST", "/v1/admin/technologies", "s3cret", `{"name": "go"}`, http.StatusConflict},
+		{"create", "POST", "/v1/admin/technologies", "s3cret", `{"name": "rust", "description": "Rust"}`, http.StatusCreated},
+		{"name mismatch", "PUT", "/v1/admin/technologies/go", "s3cret", `{"name": "rust"}`, http.StatusBadRequest},
+		{"in use", "DELETE", "/v1/admin/technologies/java", "s3cret", ``, http.StatusConflict},
+		{"delete", "DELETE", "/v1/admin/technologies/php", "s3cret", ``, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		rs := do(tt.method, tt.path, tt.token, tt.body)
+		if rs.Code != tt.wantStatus {
+			t.Errorf("%q: want status %d, have %d: %s", tt.comment, tt.wantStatus, rs.Code, rs.Body.String())
+		}
+	}
+
+	// Local catalog is updated immediately, and used for validation
+	if !technologies.Valid("rust") || technologies.Valid("php") {
+		t.Errorf("catalog not updated: %v", technologies.Names())
+	}
+	rs := do("POST", "/v1/user", "", strings.Replace(validJohnSmith, `"go"`, `"php"`, 1))
+	if rs.Code != http.StatusBadRequest || !strings.Contains(rs.Body.String(), "rust") {
+		t.Errorf("want user with removed technology rejected with list of valid ones, have %d: %s", rs.Code, rs.Body.String())
+	}
+
+	// Token must be passed with the Bearer scheme
+	rq := httptest.NewRequest("DELETE", "/v1/admin/technologies/php", nil)
+	rq.Header.Set("Authorization", "s3cret")
+	rs = httptest.NewRecorder()
+	r.ServeHTTP(rs, rq)
+	if rs.Code != http.StatusUnauthorized {
+		t.Errorf("token without scheme: want status %d, have %d", http.StatusUnauthorized, rs.Code)
+	}
+
+	srv.AdminToken = ""
+	if rs := do("POST", "/v1/admin/technologies", "", `{"name": "rust"}`); rs.Code != http.StatusForbidden {
+		t.Errorf("admin API disabled: want status %d, have %d", http.StatusForbidden, rs.Code)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// TLSFiles describes the files and settings used to build a TLS configuration
+// for the HTTP server.
+type TLSFiles struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is optional. If non-empty, clients are required to present
+	// a certificate signed by one of the CAs from this PEM bundle (mutual TLS).
+	ClientCAFile string
+	// MinVersion is one of: 1.0 1.1 1.2 1.3
+	MinVersion string
+}
+
+// TLSReloader serves TLS certificates loaded from files, allowing to re-read
+// the files at runtime without restarting the server. TLSReloader is safe for
+// concurrent use.
+type TLSReloader struct {
+	files      TLSFiles
+	minVersion uint16
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// NewTLSReloader loads the certificate files described by files. If any of
+// the files cannot be loaded, an error is returned.
+func NewTLSReloader(files TLSFiles) (*TLSReloader, error) {
+	if files.CertFile == "" || files.KeyFile == "" {
+		return nil, errors.New("both TLS certificate and key files must be provided")
+	}
+	minVersion, err := parseTLSVersion(files.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	r := &TLSReloader{
+		files:      files,
+		minVersion: minVersion,
+	}
+	err = r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the certificate files. If any of them cannot be loaded, an
+// error is returned and the previously loaded certificates stay in use.
+func (r *TLSReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.files.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.files.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("loading TLS client CA bundle: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("loading TLS client CA bundle: no certificates found in %s", r.files.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.mu.Unlock()
+	return nil
+}
+
+// ReloadOnSIGHUP starts a goroutine calling Reload every time the process
+// receives the SIGHUP signal. Reload errors are logged.
+func (r *TLSReloader) ReloadOnSIGHUP() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			err := r.Reload()
+			if err != nil {
+				log.Printf("ERROR: reloading TLS certificates on SIGHUP: %s", err)
+				continue
+			}
+			log.Printf("reloaded TLS certificates on SIGHUP")
+		}
+	}()
+}
+
+// Config returns a TLS configuration for an HTTP server, which always uses
+// the most recently loaded certificates.
+func (r *TLSReloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: r.minVersion,
+		// Note: GetConfigForClient is used so that the client CA pool can also
+		// be swapped on reload; GetCertificate is still needed for
+		// http.Server.ListenAndServeTLS to accept the config.
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.clientConfig(), nil
+		},
+	}
+}
+
+func (r *TLSReloader) clientConfig() *tls.Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c := &tls.Config{
+		MinVersion:   r.minVersion,
+		Certificates: []tls.Certificate{*r.cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if r.clientCAs != nil {
+		c.ClientCAs = r.clientCAs
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c
+}
+
+func parseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported minimum TLS version %q, must be one of: 1.0 1.1 1.2 1.3", s)
+	}
+}
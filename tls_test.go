@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSReloader_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var (
+		certFile = filepath.Join(dir, "cert.pem")
+		keyFile  = filepath.Join(dir, "key.pem")
+	)
+
+	writeTestCert(t, certFile, keyFile, "first")
+	certs, err := NewTLSReloader(TLSFiles{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	listener.TLS = certs.Config()
+	listener.StartTLS()
+	defer listener.Close()
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	servedCN := func() string {
+		rs, err := client.Get(listener.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs.Body.Close()
+		// Avoid reusing the connection, so that next request does a new handshake
+		client.CloseIdleConnections()
+		return rs.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	if cn := servedCN(); cn != "first" {
+		t.Errorf("want certificate %q, have %q", "first", cn)
+	}
+	writeTestCert(t, certFile, keyFile, "second")
+	if cn := servedCN(); cn != "first" {
+		t.Errorf("before reload: want certificate %q, have %q", "first", cn)
+	}
+	err = certs.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := servedCN(); cn != "second" {
+		t.Errorf("after reload: want certificate %q, have %q", "second", cn)
+	}
+
+	// Broken files must not replace working certificate
+	err = ioutil.WriteFile(certFile, []byte("garbage"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certs.Reload() == nil {
+		t.Errorf("want error when reloading garbage certificate")
+	}
+	if cn := servedCN(); cn != "second" {
+		t.Errorf("after failed reload: want certificate %q, have %q", "second", cn)
+	}
+}
+
+func TestTLSReloader_ClientCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var (
+		certFile       = filepath.Join(dir, "cert.pem")
+		keyFile        = filepath.Join(dir, "key.pem")
+		clientCertFile = filepath.Join(dir, "client.pem")
+		clientKeyFile  = filepath.Join(dir, "client-key.pem")
+	)
+	writeTestCert(t, certFile, keyFile, "server")
+	writeTestCert(t, clientCertFile, clientKeyFile, "client")
+
+	// The self-signed client certificate doubles as its own CA
+	certs, err := NewTLSReloader(TLSFiles{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: clientCertFile,
+		MinVersion:   "1.2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	listener.TLS = certs.Config()
+	listener.StartTLS()
+	defer listener.Close()
+
+	anonymous := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	_, err = anonymous.Get(listener.URL)
+	if err == nil {
+		t.Errorf("want error for client without certificate")
+	}
+
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticated := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{clientCert},
+		},
+	}}
+	rs, err := authenticated.Get(listener.URL)
+	if err != nil {
+		t.Fatalf("client with certificate: %s", err)
+	}
+	rs.Body.Close()
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	for _, s := range []string{"", "1.0", "1.1", "1.2", "1.3"} {
+		if _, err := parseTLSVersion(s); err != nil {
+			t.Errorf("%q: unexpected error: %s", s, err)
+		}
+	}
+	if _, err := parseTLSVersion("1.4"); err == nil {
+		t.Errorf("want error for unknown TLS version")
+	}
+}
+
+// writeTestCert generates a self-signed certificate with specified common
+// name, which can be used both for server and client authentication.
+func writeTestCert(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
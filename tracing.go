@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies spans created by this service.
+const instrumentationName = "github.com/akavel/homework200301"
+
+// Tracer records OpenTelemetry spans for incoming HTTP requests, continuing
+// traces propagated in W3C Trace Context headers, and exports finished spans
+// in batches, in background.
+type Tracer struct {
+	provider   *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// NewTracer creates a Tracer exporting spans via exporter. New traces (i.e.
+// requests without a traceparent header) are sampled with the specified
+// probability, from 0 to 1; sampling decisions of incoming traces are
+// respected.
+func NewTracer(exporter sdktrace.SpanExporter, serviceName string, sampleRatio float64) *Tracer {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName))),
+	)
+	return &Tracer{
+		provider:   provider,
+		tracer:     provider.Tracer(instrumentationName),
+		propagator: propagation.TraceContext{},
+	}
+}
+
+// NewOTLPExporter creates an exporter sending spans to an OpenTelemetry
+// collector using the OTLP/HTTP protocol. The endpoint is the full URL of the
+// traces endpoint, typically: http://localhost:4318/v1/traces
+func NewOTLPExporter(endpoint string) (sdktrace.SpanExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("bad OTLP endpoint URL %q", endpoint)
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(u.Path),
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	// Note: the exporter connects lazily, so ctx is not used for dialing
+	return otlptracehttp.New(context.Background(), opts...)
+}
+
+// Shutdown exports all queued spans and stops the Tracer. Spans ended after
+// Shutdown are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	return t.provider.Shutdown(ctx)
+}
+
+// WrapHTTPHandler starts a server span for every request handled by h,
+// continuing the trace from the incoming traceparent header if present. It is
+// intended to be used as a mux middleware, as spans are named after the
+// template of the matched mux route (e.g. GET /v1/user/{email}).
+func (t *Tracer) WrapHTTPHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		if cur := mux.CurrentRoute(r); cur != nil {
+			if tmpl, err := cur.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		ctx := t.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := t.tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("http.flavor", fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)),
+			))
+		defer span.End()
+
+		rec := &responseRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.status_code", rec.Status()))
+		if rec.Status() >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprintf("HTTP status %d", rec.Status()))
+		}
+	})
+}
+
+// traceIDFromContext returns the hex-encoded ID of the trace of the span
+// stored in ctx, or an empty string if there is none.
+func traceIDFromContext(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
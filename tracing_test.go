@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordingExporter keeps spans also after Shutdown, which flushes all of
+// them (unlike TracerProvider.ForceFlush, which skips queued ones).
+type recordingExporter struct {
+	*tracetest.InMemoryExporter
+}
+
+func (recordingExporter) Shutdown(context.Context) error { return nil }
+
+// tracedRequest sends a GET request with the specified traceparent header (if
+// not empty) through a router traced by a new Tracer with the specified
+// sample ratio, whose handler runs an SQL query hooked like by PostgresDB,
+// and returns the exported spans.
+func tracedRequest(t *testing.T, sampleRatio float64, traceparent string) tracetest.SpanStubs {
+	exporter := recordingExporter{tracetest.NewInMemoryExporter()}
+	tracer := NewTracer(exporter, "test", sampleRatio)
+	// Note: the DB is only used for formatting queries, it is not connected
+	db := pg.Connect(&pg.Options{})
+	defer db.Close()
+	r := mux.NewRouter()
+	r.Use(tracer.WrapHTTPHandler)
+	r.Methods("GET").Path("/v1/user/{email}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hook := pgQueryHook{}
+		q := &pg.QueryEvent{StartTime: time.Now(), DB: db, Query: "SELECT * FROM users WHERE email_norm = ?"}
+		ctx, _ := hook.BeforeQuery(r.Context(), q)
+		hook.AfterQuery(ctx, q)
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	rq := httptest.NewRequest("GET", "/v1/user/john@smith.com", nil)
+	if traceparent != "" {
+		rq.Header.Set("traceparent", traceparent)
+	}
+	r.ServeHTTP(httptest.NewRecorder(), rq)
+	err := tracer.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exporter.GetSpans()
+}
+
+func TestTracer_WrapHTTPHandler(t *testing.T) {
+	spans := tracedRequest(t, 1, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if len(spans) != 2 {
+		t.Fatalf("want 2 spans, have %d", len(spans))
+	}
+	query, server := spans[0], spans[1]
+	if server.Name != "GET /v1/user/{email}" || server.SpanKind != trace.SpanKindServer {
+		t.Errorf("bad server span: %q kind %s", server.Name, server.SpanKind)
+	}
+	if server.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("server span does not continue incoming trace: %s", server.SpanContext.TraceID())
+	}
+	if server.Parent.SpanID().String() != "00f067aa0ba902b7" || server.SpanContext.SpanID() == server.Parent.SpanID() {
+		t.Errorf("server span not linked to incoming span: %s", server.Parent.SpanID())
+	}
+	if query.Name != "db.query" || query.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Errorf("query span not linked to server span: %q", query.Name)
+	}
+
+	if !hasAttribute(server.Attributes, attribute.Int("http.status_code", http.StatusTeapot)) {
+		t.Errorf("missing status code attribute: %v", server.Attributes)
+	}
+	if !hasAttribute(query.Attributes, attribute.String("db.statement", "SELECT * FROM users WHERE email_norm = ?")) {
+		t.Errorf("missing statement attribute: %v", query.Attributes)
+	}
+	if server.Status.Code == codes.Error {
+		t.Errorf("want no error status for %d", http.StatusTeapot)
+	}
+	// Raw emails must not leak
+	for _, s := range spans {
+		for _, a := range s.Attributes {
+			if strings.Contains(a.Value.Emit(), "john@smith.com") {
+				t.Errorf("span %q contains raw email: %v", s.Name, a)
+			}
+		}
+	}
+}
+
+func TestTracer_Sampling(t *testing.T) {
+	// New traces are not sampled
+	if spans := tracedRequest(t, 0, ""); len(spans) != 0 {
+		t.Errorf("want no spans, have %d", len(spans))
+	}
+	// Incoming sampling decision is respected
+	if spans := tracedRequest(t, 0, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"); len(spans) != 2 {
+		t.Errorf("want 2 spans, have %d", len(spans))
+	}
+}
+
+func TestPgQueryHook_NoTrace(t *testing.T) {
+	db := pg.Connect(&pg.Options{})
+	defer db.Close()
+	hook := pgQueryHook{}
+	q := &pg.QueryEvent{StartTime: time.Now(), DB: db, Query: "SELECT 1"}
+	ctx, err := hook.BeforeQuery(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trace.SpanFromContext(ctx).SpanContext().IsValid() || traceIDFromContext(ctx) != "" {
+		t.Errorf("want no span without a tracer")
+	}
+	// Must not panic
+	hook.AfterQuery(ctx, q)
+}
+
+func hasAttribute(attrs []attribute.KeyValue, want attribute.KeyValue) bool {
+	for _, a := range attrs {
+		if a == want {
+			return true
+		}
+	}
+	return false
+}
@@ -1,31 +1,122 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"strings"
 	"time"
+
+	"github.com/nyaruka/phonenumbers"
+	"golang.org/x/net/idna"
 )
 
-var validTechnology = map[string]bool{
-	"go": true, "java": true, "js": true, "php": true,
+// defaultPhoneRegion is the region assumed for phone numbers provided without
+// an international prefix. See SetDefaultPhoneRegion.
+var defaultPhoneRegion = "PL"
+
+// SetDefaultPhoneRegion sets the region (ISO 3166-1 alpha-2 country code, e.g.
+// "PL") assumed for phone numbers provided without an international prefix.
+// It must be called before any User is validated.
+func SetDefaultPhoneRegion(region string) error {
+	region = strings.ToUpper(region)
+	if _, ok := phonenumbers.GetSupportedRegions()[region]; !ok {
+		return fmt.Errorf("unsupported phone number region %q", region)
+	}
+	defaultPhoneRegion = region
+	return nil
 }
 
-// FIXME: make Technology an enum or FK in Postgres
 // TODO: [LATER] pg-related annotations & fields are internal and should not be exposed in exported type (see orm.Table?)
 type User struct {
 	// ID is the field required by go-pg ORM as the primary key
 	ID int64 `json:"-"`
+	// PublicID is a random UUID identifying the user in the API. Unlike
+	// Email, it does not change and does not reveal personal data.
+	PublicID string `json:"id,omitempty" pg:"public_id,type:uuid"`
 
 	Name    *string `json:"name" pg:",notnull"`
 	Surname *string `json:"surname" pg:",notnull"`
 	Email   *string `json:"email" pg:",notnull"`
+	// EmailNorm is the normalized form of Email, used for lookups and for
+	// ensuring uniqueness. Email keeps the form provided by the user, for
+	// display.
+	EmailNorm string `json:"-" pg:",notnull"`
+	// EmailVerified is the time when the user confirmed controlling Email
+	// (see EmailVerifier), or nil while verification is pending. It is set
+	// by the server, and ignored in requests.
+	EmailVerified *time.Time `json:"email_verified"`
 	// FIXME: [LATER] only store a hash of the password
-	Password   *string    `json:"password" pg:",notnull"`
-	Birthday   *time.Time `json:"birthday" pg:",notnull"`
-	Address    *string    `json:"address" pg:",notnull"`
-	Phone      *string    `json:"phone,omitempty"`
+	Password *string    `json:"password,omitempty" pg:",notnull"`
+	Birthday *time.Time `json:"birthday" pg:",notnull"`
+	// Address is stored as JSON; it can be provided by clients as a
+	// free-form string for compatibility (see ParseAddress).
+	Address *Address `json:"address" pg:",notnull"`
+	Phone   *string  `json:"phone,omitempty"`
+	// Metadata is stored as JSON. If nil when modifying a User, the stored
+	// Metadata is kept unchanged.
+	Metadata Metadata `json:"metadata,omitempty"`
+	// Technology is the primary technology of the user. It is kept for
+	// compatibility with clients predating Technologies.
 	Technology *string    `json:"technology" pg:",notnull"`
 	Deleted    *time.Time `json:"deleted,omitempty"`
+
+	// Technologies are stored in a separate table.
+	Technologies []UserTechnology `json:"technologies" pg:"-"`
+}
+
+// UserTechnology describes how well a user knows a technology.
+type UserTechnology struct {
+	tableName struct{} `pg:"user_technologies"`
+
+	UserID int64       `json:"-" pg:",pk"`
+	Name   string      `json:"name" pg:"technology,pk"`
+	Level  Proficiency `json:"level,omitempty" pg:",use_zero"`
+	// Since is the date when the user started using the technology.
+	Since *time.Time `json:"since,omitempty" pg:"type:date"`
+}
+
+// Proficiency is a level of knowledge of a technology. Higher values mean
+// better knowledge.
+type Proficiency int
+
+const (
+	ProficiencyUnspecified Proficiency = iota
+	ProficiencyBeginner
+	ProficiencyIntermediate
+	ProficiencyAdvanced
+	ProficiencyExpert
+)
+
+var proficiencyNames = []string{"", "beginner", "intermediate", "advanced", "expert"}
+
+// ParseProficiency converts a name of a Proficiency level, as used in JSON,
+// to its value.
+func ParseProficiency(s string) (Proficiency, error) {
+	for i, name := range proficiencyNames {
+		if s == name && s != "" {
+			return Proficiency(i), nil
+		}
+	}
+	return 0, fmt.Errorf("proficiency level must be one of: %s", strings.Join(proficiencyNames[1:], " "))
+}
+
+func (p Proficiency) MarshalJSON() ([]byte, error) {
+	if p < 0 || int(p) >= len(proficiencyNames) {
+		return nil, fmt.Errorf("invalid proficiency level %d", int(p))
+	}
+	return json.Marshal(proficiencyNames[p])
+}
+
+func (p *Proficiency) UnmarshalJSON(buf []byte) error {
+	var s string
+	err := json.Unmarshal(buf, &s)
+	if err != nil {
+		return err
+	}
+	*p, err = ParseProficiency(s)
+	return err
 }
 
 // Validate checks if User fields have allowed values. If not, an error is
@@ -35,13 +126,62 @@ type User struct {
 //
 // - all fields except .Phone and .Delete are mandatory and should be non-nil
 //
-// - .Email must contain a '@' character
+// - .Email must contain a '@' character, with a valid domain after it;
+// whitespace around .Email is removed, and .EmailNorm is set (see
+// NormalizeEmail)
+//
+// - .Address must be complete and valid in its country (see
+// Address.Validate)
 //
-// - .Technology must match one of the values listed in validTechnology
+// - .Phone, if present, must be a valid phone number; it is converted to the
+// E.164 format (see NormalizePhone)
+//
+// - .Metadata must fit in size limits and match configured schemas (see
+// Metadata.Validate)
+//
+// - at least one of .Technology and .Technologies must be present; if only
+// one is, the other is filled based on it; .Technology must be one of
+// .Technologies, and all of them must match names in the technologies
+// catalog, without duplicates
 //
 // - .Deleted must be nil
 func (u *User) Validate() error {
 	// TODO: return all validation errors, not just the first one
+	var emailErr error
+	if u.Email != nil {
+		email := strings.TrimSpace(*u.Email)
+		u.Email = &email
+		u.EmailNorm, emailErr = NormalizeEmail(email)
+	}
+	if u.Technology == nil && len(u.Technologies) > 0 {
+		primary := u.Technologies[0].Name
+		u.Technology = &primary
+	}
+	if u.Technology != nil && len(u.Technologies) == 0 {
+		u.Technologies = []UserTechnology{{Name: *u.Technology}}
+	}
+	var technologiesErr error
+	if u.Technology != nil {
+		technologiesErr = u.validateTechnologies()
+	}
+	var addressErr error
+	if u.Address != nil {
+		addressErr = u.Address.Validate()
+	}
+	var phoneErr error
+	if u.Phone != nil {
+		var phone string
+		phone, phoneErr = NormalizePhone(*u.Phone)
+		if phoneErr == nil {
+			u.Phone = &phone
+		}
+	}
+
+	var metadataErr error
+	if u.Metadata != nil {
+		metadataErr = u.Metadata.Validate()
+	}
+
 	switch {
 
 	case u.Name == nil:
@@ -53,10 +193,11 @@ func (u *User) Validate() error {
 	case u.Email == nil:
 		return errors.New(".email mandatory field is missing")
 	case !strings.Contains(*u.Email, "@"):
-		// TODO: also verify there's something before '@' and after '@'
-		// TODO: consider more advanced validation, though this is tricky; if
-		// applicable, consider sending confirmation email instead
+		// Note: no more advanced validation, as it is tricky; instead, a
+		// confirmation email is sent (see EmailVerifier)
 		return errors.New(".email is not a valid email address")
+	case emailErr != nil:
+		return fmt.Errorf(".email is not a valid email address: %w", emailErr)
 
 	case u.Password == nil:
 		return errors.New(".password mandatory field is missing")
@@ -67,13 +208,21 @@ func (u *User) Validate() error {
 
 	case u.Address == nil:
 		return errors.New(".address mandatory field is missing")
+	case addressErr != nil:
+		return addressErr
 
-	// TODO: validate .phone contents format if field provided (there's some pkg for this IIRC)
+	case phoneErr != nil:
+		return fmt.Errorf(".phone is not a valid phone number: %w", phoneErr)
+
+	case metadataErr != nil:
+		return metadataErr
 
 	case u.Technology == nil:
 		return errors.New(".technology mandatory field is missing")
-	case !validTechnology[*u.Technology]:
-		return errors.New(".technology must be one of: go java js php")
+	case !technologies.Valid(*u.Technology):
+		return errors.New(".technology must be one of: " + strings.Join(technologies.Names(), " "))
+	case technologiesErr != nil:
+		return technologiesErr
 
 	case u.Deleted != nil:
 		return errors.New(".deleted must be empty")
@@ -85,3 +234,102 @@ func (u *User) Validate() error {
 	// question is how far we want to go with validation, e.g. is "x" a
 	// valid address?
 }
+
+func (u *User) validateTechnologies() error {
+	seen := map[string]bool{}
+	for i, t := range u.Technologies {
+		switch {
+		case !technologies.Valid(t.Name):
+			return fmt.Errorf(".technologies[%d].name must be one of: %s", i, strings.Join(technologies.Names(), " "))
+		case seen[t.Name]:
+			return fmt.Errorf(".technologies[%d].name is duplicated: %s", i, t.Name)
+		}
+		seen[t.Name] = true
+	}
+	if !seen[*u.Technology] {
+		return errors.New(".technology must be one of .technologies")
+	}
+	return nil
+}
+
+// NormalizeEmail returns the canonical form of an email address, under which
+// it is compared with other addresses: surrounding whitespace is removed, the
+// domain is converted to ASCII as per IDNA (e.g. "zażółć.pl" becomes
+// "xn--za-6ja4f8n1l.pl"), and the address is lowercased. Although RFC 5321
+// allows the local part to be case-sensitive, virtually no email provider
+// treats it so, and users don't expect it.
+func NormalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at == len(email)-1 {
+		return "", errors.New("expected local part and domain around '@'")
+	}
+	domain, err := idna.Lookup.ToASCII(email[at+1:])
+	if err != nil {
+		return "", fmt.Errorf("invalid domain: %w", err)
+	}
+	return strings.ToLower(email[:at]) + "@" + strings.ToLower(domain), nil
+}
+
+// NormalizePhone parses a phone number and returns it in the E.164 format,
+// e.g. "+48600123456". Numbers without an international prefix are assumed to
+// be from the default region (see SetDefaultPhoneRegion). Numbers which are
+// not valid in their region are rejected.
+func NormalizePhone(phone string) (string, error) {
+	num, err := phonenumbers.Parse(phone, defaultPhoneRegion)
+	if err != nil {
+		return "", err
+	}
+	if !phonenumbers.IsValidNumber(num) {
+		region := phonenumbers.GetRegionCodeForNumber(num)
+		if region == "" || region == "ZZ" {
+			return "", errors.New("unknown country calling code")
+		}
+		return "", fmt.Errorf("no such number in region %s", region)
+	}
+	return phonenumbers.Format(num, phonenumbers.E164), nil
+}
+
+// emailLookupKey returns the normalized form of email for database lookups.
+// Addresses which cannot be normalized are only lowercased, as they cannot
+// match any valid address anyway.
+func emailLookupKey(email string) string {
+	norm, err := NormalizeEmail(email)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(email))
+	}
+	return norm
+}
+
+// newPublicID generates a random (version 4) UUID.
+func newPublicID() string {
+	var buf [16]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		panic(fmt.Sprintf("reading random bytes: %s", err))
+	}
+	buf[6] = buf[6]&0x0f | 0x40 // version 4
+	buf[8] = buf[8]&0x3f | 0x80 // variant RFC 4122
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:])
+}
+
+// validPublicID checks if id is a UUID in the canonical, lowercase textual
+// form, as returned by newPublicID.
+func validPublicID(id string) bool {
+	if len(id) != 36 {
+		return false
+	}
+	for i, c := range id {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+				return false
+			}
+		}
+	}
+	return true
+}
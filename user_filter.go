@@ -2,13 +2,40 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/url"
+	"strings"
+	"time"
 )
 
 // UserFilter describes criteria for selecting User objects.
 type UserFilter struct {
 	Technology *string // nil matches any value, non-nil matches equal value in User
 	Deleted    *bool   // nil matches any value, true matches deleted User (User.Deleted!=nil), false matches active User (User.Deleted==nil)
+	Phone      *string // nil matches any value, non-nil matches equal value in User (in E.164 format)
+	Country    *string // nil matches any value, non-nil matches equal User.Address.Country
+	City       *string // nil matches any value, non-nil matches User.Address.City, ignoring case
+	Group      *string // nil matches any value, non-nil matches User who is a member of the group with that name
+	Verified   *bool   // nil matches any value, true matches User with verified email (User.EmailVerified!=nil), false matches User with verification pending
+
+	// Metadata matches User having all the listed keys in its Metadata, each
+	// with a value equal to any of the provided ones, either as a JSON
+	// string, or as another JSON scalar (e.g. "123" matches both "123" and
+	// 123).
+	Metadata map[string][]string
+
+	// Technologies, if not empty, matches User knowing any of the listed
+	// technologies (or all of them, if AllTechnologies is true) at MinLevel
+	// or better. Unlike Technology, it is not limited to the primary
+	// technology of the User.
+	Technologies    []string
+	AllTechnologies bool
+	MinLevel        Proficiency
+
+	// AsOf, if not nil, makes the filter match the state of users at that
+	// time, including users modified or deleted since. It can't be used
+	// together with Technologies or Group, which match only current state.
+	AsOf *time.Time
 }
 
 // NewUserFilter creates a UserFilter based on URL query. If the query cannot
@@ -19,11 +46,10 @@ func NewUserFilter(query url.Values) (UserFilter, error) {
 	switch v := query.Get("technology"); {
 	case v == "" || v == "*":
 		f.Technology = nil
-	case validTechnology[v]:
+	case technologies.Valid(v):
 		f.Technology = &v
 	default:
-		// TODO: [LATER] avoid duplication of valid technology values in lists
-		return UserFilter{}, errors.New("'technology' query parameter must be one of: * go java js php")
+		return UserFilter{}, errors.New("'technology' query parameter must be one of: * " + strings.Join(technologies.Names(), " "))
 	}
 
 	switch v := query.Get("deleted"); v {
@@ -37,7 +63,118 @@ func NewUserFilter(query url.Values) (UserFilter, error) {
 		return UserFilter{}, errors.New("'deleted' query parameter must be one of: * yes no true false")
 	}
 
+	switch v := query.Get("verified"); v {
+	case "", "*":
+		f.Verified = nil
+	case "yes", "true":
+		f.Verified = newBool(true)
+	case "no", "false":
+		f.Verified = newBool(false)
+	default:
+		return UserFilter{}, errors.New("'verified' query parameter must be one of: * yes no true false")
+	}
+
+	if v := query.Get("phone"); v != "" {
+		phone, err := NormalizePhone(v)
+		if err != nil {
+			return UserFilter{}, fmt.Errorf("'phone' query parameter is not a valid phone number: %w", err)
+		}
+		f.Phone = &phone
+	}
+
+	if v := query.Get("country"); v != "" {
+		country := strings.ToUpper(v)
+		if !validCountry(country) {
+			return UserFilter{}, errors.New("'country' query parameter must be an ISO 3166-1 alpha-2 country code")
+		}
+		f.Country = &country
+	}
+	if v := strings.TrimSpace(query.Get("city")); v != "" {
+		f.City = &v
+	}
+
+	if v := query.Get("group"); v != "" {
+		if !validGroupName(v) {
+			return UserFilter{}, errors.New("'group' query parameter is not a valid group name")
+		}
+		f.Group = &v
+	}
+
+	for param, values := range query {
+		if !strings.HasPrefix(param, "metadata.") {
+			continue
+		}
+		key := strings.TrimPrefix(param, "metadata.")
+		if !metadataKeyPattern.MatchString(key) {
+			return UserFilter{}, fmt.Errorf("'%s' query parameter: invalid metadata key", param)
+		}
+		if f.Metadata == nil {
+			f.Metadata = map[string][]string{}
+		}
+		f.Metadata[key] = values
+	}
+
+	if v := query.Get("technologies"); v != "" {
+		seen := map[string]bool{}
+		for _, name := range strings.Split(v, ",") {
+			if !technologies.Valid(name) {
+				return UserFilter{}, errors.New("'technologies' query parameter must be a comma-separated list of: " + strings.Join(technologies.Names(), " "))
+			}
+			// Note: repeated names are skipped, as AllTechnologies compares
+			// the number of matches with len(Technologies)
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			f.Technologies = append(f.Technologies, name)
+		}
+	}
+	switch v := query.Get("match"); v {
+	case "", "any":
+	case "all":
+		f.AllTechnologies = true
+	default:
+		return UserFilter{}, errors.New("'match' query parameter must be one of: any all")
+	}
+	if v := query.Get("min_level"); v != "" {
+		level, err := ParseProficiency(v)
+		if err != nil {
+			return UserFilter{}, fmt.Errorf("'min_level' query parameter: %w", err)
+		}
+		f.MinLevel = level
+	}
+	if (f.AllTechnologies || f.MinLevel != ProficiencyUnspecified) && len(f.Technologies) == 0 {
+		return UserFilter{}, errors.New("'match' and 'min_level' query parameters require 'technologies'")
+	}
+
+	asOf, err := ParseAsOf(query)
+	if err != nil {
+		return UserFilter{}, err
+	}
+	if asOf != nil && (len(f.Technologies) > 0 || f.Group != nil) {
+		return UserFilter{}, errors.New("'as_of' query parameter can't be combined with 'technologies' nor 'group'")
+	}
+	f.AsOf = asOf
+
 	return f, nil
 }
 
+// ParseAsOf parses the 'as_of' query parameter, which can be either an RFC
+// 3339 timestamp, or a date (meaning midnight UTC). If the parameter is not
+// present, nil is returned.
+func ParseAsOf(query url.Values) (*time.Time, error) {
+	v := query.Get("as_of")
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", v)
+	}
+	if err != nil {
+		return nil, errors.New("'as_of' query parameter must be an RFC 3339 timestamp or a date, e.g. 2020-03-01T12:00:00Z or 2020-03-01")
+	}
+	return &t, nil
+}
+
 func newBool(v bool) *bool { return &v }
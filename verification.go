@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// EmailVerifier issues tokens confirming that a user controls their email
+// address, and sends them to the address. Tokens are signed, so they don't
+// need to be stored; a token is valid until it expires, and only as long as
+// the user's email is unchanged.
+type EmailVerifier struct {
+	// Key signs the tokens (HMAC-SHA256). It must be the same in all
+	// processes serving the API, and kept secret.
+	Key []byte
+	// TTL is how long tokens are valid. Default is DefaultVerificationTTL.
+	TTL time.Duration
+	// Cooldown is the minimum time between emails sent to the same user,
+	// after which another one can be requested. Default is
+	// DefaultVerificationCooldown.
+	Cooldown time.Duration
+	// Sent tracks recently sent emails, for enforcing Cooldown. If nil,
+	// another email can be requested at any time.
+	Sent   RateLimitStore
+	Mailer Mailer
+	// LinkURL is the address of the page verifying the token, e.g. in a
+	// web app, to which the token is appended as the 'token' query
+	// parameter. If empty, the link points to the verify-email API
+	// endpoint, which serves a page confirming the address with a form
+	// (see verifyEmailForm).
+	LinkURL string
+	// SendTimeout limits sending of emails in the background (see
+	// SendInBackground). Default is DefaultVerificationSendTimeout.
+	SendTimeout time.Duration
+
+	sending sync.WaitGroup
+}
+
+// DefaultVerificationTTL is the default of EmailVerifier.TTL.
+const DefaultVerificationTTL = 48 * time.Hour
+
+// DefaultVerificationCooldown is the default of EmailVerifier.Cooldown.
+const DefaultVerificationCooldown = 5 * time.Minute
+
+// DefaultVerificationSendTimeout is the default of EmailVerifier.SendTimeout.
+const DefaultVerificationSendTimeout = 30 * time.Second
+
+// takeSend records an email sent to the user with the specified PublicID,
+// and reports if the cooldown after the previous one has passed.
+func (v *EmailVerifier) takeSend(id string, now time.Time) RateLimitResult {
+	if v.Sent == nil {
+		return RateLimitResult{Allowed: true}
+	}
+	cooldown := v.Cooldown
+	if cooldown <= 0 {
+		cooldown = DefaultVerificationCooldown
+	}
+	return v.Sent.Take("verify-email "+id, RateLimit{Requests: 1, Period: cooldown}, now)
+}
+
+var errInvalidToken = errors.New("invalid or expired verification token")
+
+// NewToken returns a token verifying the current email of u, which expires
+// after v.TTL from now. Its format is: PUBLIC_ID.EXPIRY.SIGNATURE
+func (v *EmailVerifier) NewToken(u *User, now time.Time) string {
+	ttl := v.TTL
+	if ttl <= 0 {
+		ttl = DefaultVerificationTTL
+	}
+	payload := u.PublicID + "." + strconv.FormatInt(now.Add(ttl).Unix(), 10)
+	return payload + "." + v.sign(payload, u.EmailNorm)
+}
+
+// sign returns the signature of a token payload. The email is signed too,
+// so that changing it invalidates tokens sent to the old address.
+func (v *EmailVerifier) sign(payload, emailNorm string) string {
+	mac := hmac.New(sha256.New, v.Key)
+	mac.Write([]byte(payload + "\n" + emailNorm))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// TokenUserID returns the public ID of the user for whom the token was
+// issued, if the token has not expired. The signature is not checked; see
+// CheckToken.
+func (v *EmailVerifier) TokenUserID(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || !validPublicID(parts[0]) {
+		return "", errInvalidToken
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || now.Unix() > expiry {
+		return "", errInvalidToken
+	}
+	return parts[0], nil
+}
+
+// CheckToken verifies that the token was issued by v for the current email
+// of u, and has not expired.
+func (v *EmailVerifier) CheckToken(token string, u *User, now time.Time) error {
+	id, err := v.TokenUserID(token, now)
+	if err != nil {
+		return err
+	}
+	i := strings.LastIndex(token, ".")
+	want := v.sign(token[:i], u.EmailNorm)
+	if id != u.PublicID || !hmac.Equal([]byte(token[i+1:]), []byte(want)) {
+		return errInvalidToken
+	}
+	return nil
+}
+
+// Send emails a new token to u, with a link for verifying it, built from
+// v.LinkURL or baseURL.
+func (v *EmailVerifier) Send(ctx context.Context, u *User, baseURL string) error {
+	link := v.LinkURL
+	if link == "" {
+		link = baseURL + "/v1/users/verify-email"
+	}
+	sep := "?"
+	if strings.Contains(link, "?") {
+		sep = "&"
+	}
+	link += sep + "token=" + url.QueryEscape(v.NewToken(u, time.Now()))
+
+	name := ""
+	if u.Name != nil {
+		name = " " + *u.Name
+	}
+	err := v.Mailer.Send(ctx, &Mail{
+		To:      *u.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hello%s,\n\n"+
+			"please confirm your email address by opening the link below:\n\n"+
+			"%s\n\n"+
+			"If you didn't create an account, you can ignore this message.\n",
+			name, link),
+	})
+	if err != nil {
+		return fmt.Errorf("sending verification email: %w", err)
+	}
+	return nil
+}
+
+// SendInBackground is like Send, but returns immediately, and sends the
+// email in a goroutine, limited by v.SendTimeout instead of ctx. Failures
+// are only logged, with the request information found in ctx. See also Wait.
+func (v *EmailVerifier) SendInBackground(ctx context.Context, u *User, baseURL string) {
+	timeout := v.SendTimeout
+	if timeout <= 0 {
+		timeout = DefaultVerificationSendTimeout
+	}
+	u2 := *u
+	v.sending.Add(1)
+	go func() {
+		defer v.sending.Done()
+		sendCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		err := v.Send(sendCtx, &u2, baseURL)
+		if err != nil {
+			logf(ctx, "ERROR: user %s: %s", u2.PublicID, err)
+		}
+	}()
+}
+
+// Wait waits until all emails sent with SendInBackground are sent, or fail.
+func (v *EmailVerifier) Wait() {
+	v.sending.Wait()
+}
+
+// sendVerification sends a verification email to a new user, if
+// verification is enabled. The email is sent in the background, so that
+// a slow mail server doesn't delay the response; failures are only logged,
+// as the user can ask for another email (see resendVerification).
+func (s *Server) sendVerification(r *http.Request, u *User) {
+	if s.Verifier == nil {
+		return
+	}
+	s.Verifier.takeSend(u.PublicID, time.Now())
+	s.Verifier.SendInBackground(r.Context(), u, s.baseURL(r))
+}
+
+// verifyEmailPage is served at links in verification emails. Opening a link
+// doesn't verify the email by itself, as links in emails are also opened by
+// mail scanners and link previews; instead, the page has a form posting the
+// token (kept in the query) back to the same URL.
+var verifyEmailPage = template.Must(template.New("verify-email").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Confirm your email address</title>
+</head>
+<body>
+{{if .Error}}<p>{{.Error}}</p>
+{{else if .Verified}}<p>Your email address is confirmed. Thank you!</p>
+{{else}}<form method="POST">
+<p><button type="submit">Confirm my email address</button></p>
+</form>
+{{end}}</body>
+</html>
+`))
+
+type verifyEmailPageData struct {
+	Verified bool
+	Error    string
+}
+
+func renderVerifyEmailPage(w http.ResponseWriter, status int, data verifyEmailPageData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// Don't keep the token in caches, nor pass it on in Referer headers
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(status)
+	verifyEmailPage.Execute(w, data)
+}
+
+// verifyEmailForm serves the page linked to in verification emails, with a
+// form submitting the token from the 'token' query parameter to verifyEmail.
+// Expired or malformed tokens are reported on the page right away.
+func (s *Server) verifyEmailForm(w http.ResponseWriter, r *http.Request) {
+	if s.Verifier == nil {
+		RespondError(w, http.StatusForbidden, errors.New("email verification is disabled"))
+		return
+	}
+	_, err := s.Verifier.TokenUserID(r.URL.Query().Get("token"), time.Now())
+	if err != nil {
+		renderVerifyEmailPage(w, http.StatusBadRequest, verifyEmailPageData{Error: err.Error()})
+		return
+	}
+	renderVerifyEmailPage(w, http.StatusOK, verifyEmailPageData{})
+}
+
+// verifyEmail marks the email of a user as verified, given a token sent to
+// it. The token is taken from the 'token' query parameter (for the form of
+// verifyEmailForm), or from a JSON body like {"token": "..."}. Verifying an
+// already verified email succeeds. Requests submitted from the form get an
+// HTML page in response.
+func (s *Server) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	if s.Verifier == nil {
+		RespondError(w, http.StatusForbidden, errors.New("email verification is disabled"))
+		return
+	}
+	form := submittedForm(r)
+	token := r.URL.Query().Get("token")
+	if token == "" && !form {
+		var body struct {
+			Token string `json:"token"`
+		}
+		status, err := DecodeJSON(r, s.maxBodyBytes(), &body)
+		if err != nil {
+			RespondError(w, status, err)
+			return
+		}
+		token = body.Token
+	}
+
+	status, err := s.verifyEmailToken(r.Context(), token)
+	switch {
+	case !form && err != nil:
+		RespondError(w, status, err)
+	case !form:
+		RespondJSON(w, http.StatusNoContent, nil)
+	case status >= 500:
+		logf(r.Context(), "ERROR: verifying email: %s", err)
+		renderVerifyEmailPage(w, status, verifyEmailPageData{Error: "Something went wrong, please try again later."})
+	case err != nil:
+		renderVerifyEmailPage(w, status, verifyEmailPageData{Error: err.Error()})
+	default:
+		renderVerifyEmailPage(w, http.StatusOK, verifyEmailPageData{Verified: true})
+	}
+}
+
+// verifyEmailToken marks the email of the user for whom the token was issued
+// as verified. On failure, it returns the HTTP status to respond with.
+func (s *Server) verifyEmailToken(ctx context.Context, token string) (int, error) {
+	now := time.Now()
+	id, err := s.Verifier.TokenUserID(token, now)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	u, err := s.DB.GetUserByID(ctx, id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if u == nil || s.Verifier.CheckToken(token, u, now) != nil {
+		return http.StatusBadRequest, errInvalidToken
+	}
+	if u.EmailVerified != nil {
+		return http.StatusOK, nil
+	}
+
+	err = s.DB.VerifyUserEmail(ctx, id, u.EmailNorm)
+	if err != nil {
+		if errors.As(err, &ErrNotFound{}) {
+			// Email changed or user deleted meanwhile
+			return http.StatusBadRequest, errInvalidToken
+		}
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// resendVerification sends a new verification email to a user whose email
+// is not verified yet, e.g. after the previous token expired, or the email
+// was changed. As anybody can request it, it is refused until the cooldown
+// after the previous email passes, so that users can't be flooded.
+func (s *Server) resendVerification(w http.ResponseWriter, r *http.Request) {
+	if s.Verifier == nil {
+		RespondError(w, http.StatusForbidden, errors.New("email verification is disabled"))
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if !validPublicID(id) {
+		RespondError(w, http.StatusNotFound, errors.New("user not found"))
+		return
+	}
+
+	u, err := s.DB.GetUserByID(r.Context(), id)
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if u == nil {
+		RespondError(w, http.StatusNotFound, errors.New("user not found"))
+		return
+	}
+	if u.EmailVerified != nil {
+		RespondError(w, http.StatusConflict, errors.New("email is already verified"))
+		return
+	}
+	if result := s.Verifier.takeSend(id, time.Now()); !result.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+		RespondError(w, http.StatusTooManyRequests, errors.New("verification email was sent recently, try again later"))
+		return
+	}
+	err = s.Verifier.Send(r.Context(), u, s.baseURL(r))
+	if err != nil {
+		RespondError(w, http.StatusBadGateway, err)
+		return
+	}
+	RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// submittedForm reports if r was submitted from an HTML form.
+func submittedForm(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/x-www-form-urlencoded"
+}
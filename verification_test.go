@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// capturingMailer records sent messages instead of sending them.
+type capturingMailer struct {
+	sent []*Mail
+	err  error
+}
+
+func (m *capturingMailer) Send(_ context.Context, msg *Mail) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func TestEmailVerifier_Token(t *testing.T) {
+	v := &EmailVerifier{Key: []byte("0123456789abcdef"), TTL: time.Hour}
+	now := time.Unix(1600000000, 0)
+	u := &User{PublicID: newPublicID(), EmailNorm: "john@smith.com"}
+	token := v.NewToken(u, now)
+
+	id, err := v.TokenUserID(token, now.Add(59*time.Minute))
+	if err != nil || id != u.PublicID {
+		t.Errorf("want ID %s, have %q, error: %v", u.PublicID, id, err)
+	}
+	if err := v.CheckToken(token, u, now.Add(59*time.Minute)); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	other := &User{PublicID: u.PublicID, EmailNorm: "john@example.com"}
+	tests := []struct {
+		comment string
+		token   string
+		user    *User
+		now     time.Time
+	}{
+		{"expired", token, u, now.Add(61 * time.Minute)},
+		{"email changed", token, other, now},
+		{"other key", (&EmailVerifier{Key: []byte("fedcba9876543210")}).NewToken(u, now), u, now},
+		{"extended expiry", strings.Replace(token, ".1600003600.", ".1700000000.", 1), u, now},
+		{"other user", token, &User{PublicID: newPublicID(), EmailNorm: u.EmailNorm}, now},
+		{"malformed", "abc", u, now},
+		{"empty", "", u, now},
+	}
+	for _, tt := range tests {
+		if err := v.CheckToken(tt.token, tt.user, tt.now); err == nil {
+			t.Errorf("%q: want error", tt.comment)
+		}
+	}
+}
+
+func TestServer_EmailVerification(t *testing.T) {
+	const userID = "7b1a8c3e-2f4d-4e5a-9b6c-0d1e2f3a4b5c"
+	stored := &User{PublicID: userID, Email: newString("john@smith.com"), EmailNorm: "john@smith.com"}
+	mailer := &capturingMailer{}
+	verified := 0
+	srv := Server{
+		DB: callbackDB{
+			createUser: func(u *User) error {
+				u.PublicID = userID
+				u.EmailNorm = emailLookupKey(*u.Email)
+				return nil
+			},
+			getUserByID: func(id string) (*User, error) {
+				if id != userID {
+					return nil, nil
+				}
+				u := *stored
+				return &u, nil
+			},
+			verifyUserEmail: func(id, emailNorm string) error {
+				if emailNorm != stored.EmailNorm {
+					return ErrNotFound{wraperr{errors.New("FAKE ERROR")}}
+				}
+				verified++
+				return nil
+			},
+		},
+		Verifier: &EmailVerifier{
+			Key:      []byte("0123456789abcdef"),
+			Cooldown: time.Hour,
+			Sent:     NewMemoryRateLimitStore(),
+			Mailer:   mailer,
+		},
+	}
+	r := mux.NewRouter()
+	srv.RegisterAt(r)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rq := httptest.NewRequest(method, "http://example.com"+path, strings.NewReader(body))
+		rq.Header.Set("Content-Type", "application/json")
+		if method == "POST" && body == "" && strings.Contains(path, "?token=") {
+			// Submitted from the form served at the link
+			rq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		rs := httptest.NewRecorder()
+		r.ServeHTTP(rs, rq)
+		return rs
+	}
+
+	// Creating a user sends a link to the verify endpoint
+	rs := do("POST", "/v1/user", validJohnSmith)
+	if rs.Code != http.StatusCreated {
+		t.Fatalf("want status %d, have %d: %s", http.StatusCreated, rs.Code, rs.Body.String())
+	}
+	srv.Verifier.Wait()
+	if len(mailer.sent) != 1 || mailer.sent[0].To != "john@smith.com" {
+		t.Fatalf("bad mails sent: %+v", mailer.sent)
+	}
+	const prefix = "http://example.com/v1/users/verify-email?token="
+	i := strings.Index(mailer.sent[0].Body, prefix)
+	if i < 0 {
+		t.Fatalf("no link in mail: %s", mailer.sent[0].Body)
+	}
+	link := strings.Fields(mailer.sent[0].Body[i:])[0]
+	token, _ := url.QueryUnescape(strings.TrimPrefix(link, prefix))
+
+	tests := []struct {
+		comment      string
+		method       string
+		path         string
+		body         string
+		wantStatus   int
+		wantBody     string
+		wantVerified int
+	}{
+		{"invalid token", "POST", "/v1/users/verify-email", `{"token": "abc"}`, http.StatusBadRequest, "", 0},
+		{"tampered token", "POST", "/v1/users/verify-email", `{"token": "` + token + `x"}`, http.StatusBadRequest, "", 0},
+		{"expired link", "GET", "/v1/users/verify-email?token=abc", ``, http.StatusBadRequest, "invalid or expired", 0},
+		{"link", "GET", strings.TrimPrefix(link, "http://example.com"), ``, http.StatusOK, `<form method="POST">`, 0},
+		{"form tampered", "POST", "/v1/users/verify-email?token=" + url.QueryEscape(token+"x"), ``, http.StatusBadRequest, "invalid or expired", 0},
+		{"form", "POST", strings.TrimPrefix(link, "http://example.com"), ``, http.StatusOK, "is confirmed", 1},
+		{"body", "POST", "/v1/users/verify-email", `{"token": "` + token + `"}`, http.StatusNoContent, "", 2},
+		{"resend too early", "POST", "/v1/users/by-id/" + userID + "/verify-email", ``, http.StatusTooManyRequests, "", 2},
+		{"resend missing", "POST", "/v1/users/by-id/0f9e8d7c-6b5a-4c3d-8e2f-1a0b9c8d7e6f/verify-email", ``, http.StatusNotFound, "", 2},
+	}
+	for _, tt := range tests {
+		rs := do(tt.method, tt.path, tt.body)
+		if rs.Code != tt.wantStatus {
+			t.Errorf("%q: want status %d, have %d: %s", tt.comment, tt.wantStatus, rs.Code, rs.Body.String())
+		}
+		if !strings.Contains(rs.Body.String(), tt.wantBody) {
+			t.Errorf("%q: want body containing %q, have: %s", tt.comment, tt.wantBody, rs.Body.String())
+		}
+		if verified != tt.wantVerified {
+			t.Errorf("%q: want %d verifications, have %d", tt.comment, tt.wantVerified, verified)
+		}
+	}
+	if len(mailer.sent) != 1 {
+		t.Errorf("want 1 mail sent, have %d", len(mailer.sent))
+	}
+
+	// Resending after the cooldown, emulated with a fresh store
+	srv.Verifier.Sent = NewMemoryRateLimitStore()
+	if rs := do("POST", "/v1/users/by-id/"+userID+"/verify-email", ""); rs.Code != http.StatusNoContent || len(mailer.sent) != 2 {
+		t.Errorf("resend: want status %d and 2 mails sent, have %d and %d", http.StatusNoContent, rs.Code, len(mailer.sent))
+	}
+	if rs := do("POST", "/v1/users/by-id/"+userID+"/verify-email", ""); rs.Code != http.StatusTooManyRequests || rs.Header().Get("Retry-After") == "" {
+		t.Errorf("resend again: want status %d with Retry-After, have %d", http.StatusTooManyRequests, rs.Code)
+	}
+
+	// Email changed after the token was sent
+	stored.EmailNorm = "john@example.com"
+	if rs := do("POST", "/v1/users/verify-email?token="+url.QueryEscape(token), ""); rs.Code != http.StatusBadRequest {
+		t.Errorf("changed email: want status %d, have %d", http.StatusBadRequest, rs.Code)
+	}
+
+	// Already verified
+	now := time.Now()
+	stored.EmailVerified = &now
+	if rs := do("POST", "/v1/users/by-id/"+userID+"/verify-email", ""); rs.Code != http.StatusConflict {
+		t.Errorf("resend verified: want status %d, have %d", http.StatusConflict, rs.Code)
+	}
+
+	// Sending failed
+	stored.EmailVerified = nil
+	srv.Verifier.Sent = NewMemoryRateLimitStore()
+	mailer.err = errors.New("FAKE ERROR")
+	if rs := do("POST", "/v1/users/by-id/"+userID+"/verify-email", ""); rs.Code != http.StatusBadGateway {
+		t.Errorf("resend failing: want status %d, have %d", http.StatusBadGateway, rs.Code)
+	}
+
+	// Verification disabled
+	srv.Verifier = nil
+	if rs := do("POST", "/v1/users/verify-email?token="+url.QueryEscape(token), ""); rs.Code != http.StatusForbidden {
+		t.Errorf("disabled: want status %d, have %d", http.StatusForbidden, rs.Code)
+	}
+}
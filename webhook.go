@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Webhook is a URL to which user events are delivered (see UserEvent), for
+// partner systems which want them pushed instead of reading the events feed.
+type Webhook struct {
+	ID  string `json:"id" pg:",pk,type:uuid"`
+	URL string `json:"url" pg:",notnull"`
+	// EventTypes limits the delivered events to the listed types. If empty,
+	// all events are delivered.
+	EventTypes []string `json:"event_types" pg:",array,use_zero"`
+	// Secret is the key of the HMAC signature of deliveries (see
+	// WebhookSender). It is only returned to clients when the webhook is
+	// created.
+	Secret  string    `json:"secret,omitempty" pg:",notnull"`
+	Created time.Time `json:"created" pg:"default:now()"`
+}
+
+// Validate checks if the Webhook can be stored. If w.Secret is empty, a
+// random one is generated.
+func (w *Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	switch {
+	case w.URL == "":
+		return errors.New(".url mandatory field is missing")
+	case len(w.URL) > 2000:
+		return errors.New(".url must be at most 2000 characters long")
+	case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+		return errors.New(".url must be an absolute http or https URL")
+	case !publicHost(u.Hostname()):
+		return errors.New(".url must not point to a loopback, link-local or private address")
+	}
+	for i, t := range w.EventTypes {
+		switch t {
+		case UserCreated, UserModified, UserDeleted, UserRestored:
+		default:
+			return fmt.Errorf(".event_types[%d] must be one of: %s %s %s %s", i, UserCreated, UserModified, UserDeleted, UserRestored)
+		}
+	}
+	if w.EventTypes == nil {
+		w.EventTypes = []string{}
+	}
+	switch {
+	case w.Secret == "":
+		w.Secret = newWebhookSecret()
+	case len(w.Secret) < 16 || len(w.Secret) > 256:
+		return errors.New(".secret must be between 16 and 256 characters long")
+	}
+	return nil
+}
+
+// nonPublicNets lists private and shared address ranges (see publicIP).
+var nonPublicNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // "this network"
+		"10.0.0.0/8",     // private
+		"100.64.0.0/10",  // carrier-grade NAT
+		"172.16.0.0/12",  // private
+		"192.168.0.0/16", // private
+		"fc00::/7",       // unique local
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// publicIP checks if ip is a public unicast address, i.e. not a loopback,
+// link-local (which includes cloud metadata endpoints), private, nor
+// multicast one. Webhooks may only target public addresses, so that admins
+// can't make the server send requests into the internal network.
+func publicIP(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicHost checks if host (from a URL) is not a loopback name, nor an IP
+// address which is not public (see publicIP). Other names are checked only
+// after being resolved, when connecting (see webhookClient).
+func publicHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return publicIP(ip)
+	}
+	return true
+}
+
+func newWebhookSecret() string {
+	var buf [32]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		panic(fmt.Sprintf("reading random bytes: %s", err))
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// States of WebhookDelivery.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	// DeliveryDead marks deliveries which failed too many times. They are
+	// not retried, unless requested through the API.
+	DeliveryDead = "dead"
+)
+
+// WebhookDelivery is an entry of the queue of events to be delivered to a
+// Webhook. Delivered and dead entries are kept as the delivery log.
+type WebhookDelivery struct {
+	tableName struct{} `pg:"webhook_deliveries,alias:delivery"`
+
+	ID          int64      `json:"id"`
+	WebhookID   string     `json:"webhook_id" pg:",type:uuid"`
+	EventID     int64      `json:"event_id"`
+	State       string     `json:"state" pg:"default:'pending'"`
+	Attempts    int        `json:"attempts" pg:",use_zero"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+	// LastStatus is the HTTP status of the response to the last attempt,
+	// or 0 if no response was received.
+	LastStatus int       `json:"last_status,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+	Created    time.Time `json:"created" pg:"default:now()"`
+}
+
+// WebhookSender posts user events to webhooks. Each request carries the
+// event as a JSON body, with headers:
+//
+//	X-Webhook-Delivery: ID of the delivery, same in retries
+//	X-Webhook-Event: type of the event, e.g. user.created
+//	X-Webhook-Signature: t=TIMESTAMP,v1=SIGNATURE
+//
+// where TIMESTAMP is the Unix time of sending, and SIGNATURE is the hex
+// encoded HMAC-SHA256 of "TIMESTAMP.BODY", keyed with Webhook.Secret.
+// Receivers should verify the signature, and reject old timestamps to
+// prevent replays. Any 2xx response status means successful delivery.
+type WebhookSender struct {
+	// Client sends the requests. Default is webhookClient, which refuses
+	// to connect to addresses which are not public.
+	Client *http.Client
+	// Timeout limits the time of a single delivery attempt. Default is
+	// DefaultWebhookTimeout.
+	Timeout time.Duration
+	// MaxAttempts is the number of failed attempts after which a delivery
+	// becomes dead. Default is DefaultWebhookMaxAttempts.
+	MaxAttempts int
+}
+
+// DefaultWebhookTimeout is the default of WebhookSender.Timeout.
+const DefaultWebhookTimeout = 10 * time.Second
+
+// DefaultWebhookMaxAttempts is the default of WebhookSender.MaxAttempts,
+// spanning about 15 hours of retries (see webhookBackoff).
+const DefaultWebhookMaxAttempts = 12
+
+func (s *WebhookSender) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return DefaultWebhookTimeout
+}
+
+func (s *WebhookSender) maxAttempts() int {
+	if s.MaxAttempts > 0 {
+		return s.MaxAttempts
+	}
+	return DefaultWebhookMaxAttempts
+}
+
+// webhookBackoff returns the delay before retrying a delivery which failed
+// the specified number of times: 30s, 1m, 2m, ... up to 6h.
+func webhookBackoff(attempts int) time.Duration {
+	const maxBackoff = 6 * time.Hour
+	backoff := 30 * time.Second
+	for i := 1; i < attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+// Send posts the event to the webhook, returning the HTTP status of the
+// response if one was received.
+func (s *WebhookSender) Send(ctx context.Context, w *Webhook, deliveryID int64, e *UserEvent) (int, error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return 0, fmt.Errorf("encoding event %d: %w", e.ID, err)
+	}
+	rq, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	rq = rq.WithContext(ctx)
+	rq.Header.Set("Content-Type", "application/json")
+	rq.Header.Set("User-Agent", "users_go-webhooks")
+	rq.Header.Set("X-Webhook-Delivery", strconv.FormatInt(deliveryID, 10))
+	rq.Header.Set("X-Webhook-Event", e.Type)
+	rq.Header.Set("X-Webhook-Signature", SignWebhook(w.Secret, time.Now(), body))
+
+	client := s.Client
+	if client == nil {
+		client = webhookClient
+	}
+	resp, err := client.Do(rq)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Read some of the body, to allow reusing the connection
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with HTTP status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// SignWebhook returns the value of the X-Webhook-Signature header for body
+// sent at time t. See WebhookSender.
+func SignWebhook(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	list, err := s.DB.ListWebhooks(r.Context())
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if list == nil {
+		list = []*Webhook{}
+	}
+	for _, h := range list {
+		h.Secret = ""
+	}
+	RespondJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) getWebhook(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !validPublicID(id) {
+		RespondJSON(w, http.StatusNotFound, nil)
+		return
+	}
+
+	found, err := s.DB.GetWebhook(r.Context(), id)
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if found != nil {
+		found.Secret = ""
+		RespondJSON(w, http.StatusOK, found)
+	} else {
+		RespondJSON(w, http.StatusNotFound, nil)
+	}
+}
+
+func (s *Server) createWebhook(w http.ResponseWriter, r *http.Request) {
+	var h Webhook
+	status, err := DecodeJSON(r, s.maxBodyBytes(), &h)
+	if err != nil {
+		RespondError(w, status, err)
+		return
+	}
+	if h.ID != "" {
+		RespondError(w, http.StatusBadRequest, errors.New(".id is assigned by the server and must be empty"))
+		return
+	}
+	err = h.Validate()
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.DB.CreateWebhook(r.Context(), &h)
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Add("Location", s.baseURL(r)+"/v1/admin/webhooks/"+h.ID)
+	// The secret is returned only once, so that the client can verify
+	// signatures
+	RespondJSON(w, http.StatusCreated, &h)
+}
+
+// modifyWebhook replaces the URL and event types of a webhook. The secret is
+// replaced only if provided.
+func (s *Server) modifyWebhook(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !validPublicID(id) {
+		RespondError(w, http.StatusNotFound, errors.New("webhook not found"))
+		return
+	}
+
+	var h Webhook
+	status, err := DecodeJSON(r, s.maxBodyBytes(), &h)
+	if err != nil {
+		RespondError(w, status, err)
+		return
+	}
+	if h.ID != "" && h.ID != id {
+		RespondError(w, http.StatusBadRequest, errors.New(".id field does not match the value in the URL"))
+		return
+	}
+	keepSecret := h.Secret == ""
+	err = h.Validate()
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if keepSecret {
+		h.Secret = ""
+	}
+	h.ID = id
+
+	err = s.DB.ModifyWebhook(r.Context(), &h)
+	if err != nil {
+		if errors.As(err, &ErrNotFound{}) {
+			RespondError(w, http.StatusNotFound, err)
+			return
+		}
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// deleteWebhook removes a webhook together with its delivery log.
+func (s *Server) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !validPublicID(id) {
+		RespondError(w, http.StatusNotFound, errors.New("webhook not found"))
+		return
+	}
+
+	err := s.DB.DeleteWebhook(r.Context(), id)
+	if err != nil {
+		if errors.As(err, &ErrNotFound{}) {
+			RespondError(w, http.StatusNotFound, err)
+			return
+		}
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// listWebhookDeliveries responds with the delivery log of a webhook, newest
+// first. The 'state' query parameter limits it to deliveries in the
+// specified state, e.g. 'dead'.
+func (s *Server) listWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !validPublicID(id) {
+		RespondError(w, http.StatusNotFound, errors.New("webhook not found"))
+		return
+	}
+	state := r.URL.Query().Get("state")
+	switch state {
+	case "", DeliveryPending, DeliveryDelivered, DeliveryDead:
+	default:
+		RespondError(w, http.StatusBadRequest, fmt.Errorf("'state' query parameter must be one of: %s %s %s", DeliveryPending, DeliveryDelivered, DeliveryDead))
+		return
+	}
+
+	found, err := s.DB.GetWebhook(r.Context(), id)
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if found == nil {
+		RespondError(w, http.StatusNotFound, errors.New("webhook not found"))
+		return
+	}
+
+	list, err := s.DB.ListWebhookDeliveries(r.Context(), id, state)
+	if err != nil {
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if list == nil {
+		list = []*WebhookDelivery{}
+	}
+	RespondJSON(w, http.StatusOK, list)
+}
+
+// retryWebhookDelivery puts a dead delivery back into the queue.
+func (s *Server) retryWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	deliveryID, err := strconv.ParseInt(mux.Vars(r)["delivery"], 10, 64)
+	if !validPublicID(id) || err != nil {
+		RespondError(w, http.StatusNotFound, errors.New("webhook delivery not found"))
+		return
+	}
+
+	err = s.DB.RetryWebhookDelivery(r.Context(), id, deliveryID)
+	if err != nil {
+		if errors.As(err, &ErrNotFound{}) {
+			RespondError(w, http.StatusNotFound, err)
+			return
+		}
+		RespondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// webhookClient is the default WebhookSender.Client. It refuses to connect
+// to addresses which are not public (see publicIP), also when a host name
+// resolves to one, or when redirected to one. It doesn't use proxies.
+var webhookClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control: func(_, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+					return fmt.Errorf("webhook address %s is not public", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	},
+}
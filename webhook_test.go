@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestWebhook_Validate(t *testing.T) {
+	tests := []struct {
+		webhook Webhook
+		wantErr string
+	}{
+		{Webhook{URL: "https://partner.example.com/hooks/users"}, ""},
+		{Webhook{URL: "http://partner.example.com:8081", EventTypes: []string{UserCreated, UserRestored}}, ""},
+		{Webhook{URL: "http://203.0.113.7/hooks"}, ""},
+		{Webhook{URL: "https://partner.example.com", Secret: "0123456789abcdef"}, ""},
+		{Webhook{}, ".url"},
+		{Webhook{URL: "ftp://partner.example.com"}, ".url"},
+		{Webhook{URL: "/hooks/users"}, ".url"},
+		{Webhook{URL: "http://localhost:8081"}, ".url"},
+		{Webhook{URL: "http://api.localhost/hooks"}, ".url"},
+		{Webhook{URL: "http://127.0.0.1:8081"}, ".url"},
+		{Webhook{URL: "http://[::1]:8081"}, ".url"},
+		{Webhook{URL: "http://169.254.169.254/latest/meta-data/"}, ".url"},
+		{Webhook{URL: "http://10.1.2.3/hooks"}, ".url"},
+		{Webhook{URL: "http://192.168.0.10/hooks"}, ".url"},
+		{Webhook{URL: "http://[fd00::1]/hooks"}, ".url"},
+		{Webhook{URL: "https://partner.example.com", EventTypes: []string{"user.updated"}}, ".event_types[0]"},
+		{Webhook{URL: "https://partner.example.com", Secret: "short"}, ".secret"},
+	}
+	for _, tt := range tests {
+		h := tt.webhook
+		err := h.Validate()
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%+v: unexpected error: %s", tt.webhook, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%+v: want error mentioning %q, have: %v", tt.webhook, tt.wantErr, err)
+		case err == nil && (h.EventTypes == nil || len(h.Secret) < 16):
+			t.Errorf("%+v: want defaults filled, have: %+v", tt.webhook, h)
+		}
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	// Expected value computed with:
+	// python3 -c 'import hmac,hashlib;print(hmac.new(b"0123456789abcdef",b"1600000000.{\"id\":1}",hashlib.sha256).hexdigest())'
+	have := SignWebhook("0123456789abcdef", time.Unix(1600000000, 0), []byte(`{"id":1}`))
+	want := "t=1600000000,v1=01a20a0b6b06c12f50a3a8095cdf12629a23a2f7d819da3daba78ecbeff7e2bd"
+	if have != want {
+		t.Errorf("want: %s\nhave: %s", want, have)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{5, 8 * time.Minute},
+		{11, 6 * time.Hour},
+		{100, 6 * time.Hour},
+	}
+	for _, tt := range tests {
+		if have := webhookBackoff(tt.attempts); have != tt.want {
+			t.Errorf("%d attempts: want %s, have %s", tt.attempts, tt.want, have)
+		}
+	}
+}
+
+func TestWebhookSender_Send(t *testing.T) {
+	const secret = "0123456789abcdef"
+	status := http.StatusNoContent
+	var got *http.Request
+	var gotBody []byte
+	partner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		gotBody, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer partner.Close()
+
+	// Note: the default client refuses to connect to the local partner
+	s := &WebhookSender{Client: partner.Client()}
+	h := &Webhook{URL: partner.URL + "/hooks", Secret: secret}
+	e := &UserEvent{ID: 42, Type: UserDeleted, UserID: "7b1a8c3e-2f4d-4e5a-9b6c-0d1e2f3a4b5c"}
+	have, err := s.Send(context.Background(), h, 7, e)
+	if err != nil || have != http.StatusNoContent {
+		t.Fatalf("want status %d, have %d, error: %v", http.StatusNoContent, have, err)
+	}
+	if got.URL.Path != "/hooks" || got.Header.Get("X-Webhook-Delivery") != "7" || got.Header.Get("X-Webhook-Event") != UserDeleted {
+		t.Errorf("bad request: %s %v", got.URL, got.Header)
+	}
+	var sent UserEvent
+	if json.Unmarshal(gotBody, &sent) != nil || sent.ID != 42 {
+		t.Errorf("bad body: %s", gotBody)
+	}
+	// Signature can be verified by the receiver
+	signature := got.Header.Get("X-Webhook-Signature")
+	var timestamp int64
+	for _, part := range strings.Split(signature, ",") {
+		if strings.HasPrefix(part, "t=") {
+			timestamp, _ = strconv.ParseInt(part[2:], 10, 64)
+		}
+	}
+	if signature != SignWebhook(secret, time.Unix(timestamp, 0), gotBody) {
+		t.Errorf("bad signature: %s", signature)
+	}
+
+	status = http.StatusServiceUnavailable
+	have, err = s.Send(context.Background(), h, 7, e)
+	if err == nil || have != http.StatusServiceUnavailable {
+		t.Errorf("want error and status %d, have %d, error: %v", http.StatusServiceUnavailable, have, err)
+	}
+
+	// Default client refuses to connect to non-public addresses, whatever
+	// the URL stored
+	got = nil
+	have, err = (&WebhookSender{}).Send(context.Background(), h, 7, e)
+	if err == nil || !strings.Contains(err.Error(), "not public") || got != nil {
+		t.Errorf("want refused connection to %s, have status %d, error: %v", partner.URL, have, err)
+	}
+}
+
+func TestServer_Webhooks(t *testing.T) {
+	const hookID = "7b1a8c3e-2f4d-4e5a-9b6c-0d1e2f3a4b5c"
+	stored := &Webhook{ID: hookID, URL: "https://partner.example.com", EventTypes: []string{}, Secret: "0123456789abcdef"}
+	var modified *Webhook
+	srv := Server{
+		DB: callbackDB{
+			listWebhooks: func() ([]*Webhook, error) {
+				h := *stored
+				return []*Webhook{&h}, nil
+			},
+			getWebhook: func(id string) (*Webhook, error) {
+				if id != hookID {
+					return nil, nil
+				}
+				h := *stored
+				return &h, nil
+			},
+			createWebhook: func(h *Webhook) error {
+				h.ID = "0f9e8d7c-6b5a-4c3d-8e2f-1a0b9c8d7e6f"
+				return nil
+			},
+			modifyWebhook: func(h *Webhook) error {
+				if h.ID != hookID {
+					return ErrNotFound{wraperr{errors.New("FAKE ERROR")}}
+				}
+				modified = h
+				return nil
+			},
+			listDeliveries: func(webhookID, state string) ([]*WebhookDelivery, error) {
+				return []*WebhookDelivery{{ID: 1, WebhookID: webhookID, State: DeliveryDead}}, nil
+			},
+			retryDelivery: func(webhookID string, id int64) error {
+				if id != 1 {
+					return ErrNotFound{wraperr{errors.New("FAKE ERROR")}}
+				}
+				return nil
+			},
+		},
+		AdminToken: "s3cret",
+	}
+	r := mux.NewRouter()
+	srv.RegisterAt(r)
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		rq := httptest.NewRequest(method, path, strings.NewReader(body))
+		rq.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			rq.Header.Set("Authorization", "Bearer "+token)
+		}
+		rs := httptest.NewRecorder()
+		r.ServeHTTP(rs, rq)
+		return rs
+	}
+
+	tests := []struct {
+		comment    string
+		method     string
+		path       string
+		token      string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"no token", "GET", "/v1/admin/webhooks", "", ``, http.StatusUnauthorized, ""},
+		{"invalid", "POST", "/v1/admin/webhooks", "s3cret", `{"url": "partner.example.com"}`, http.StatusBadRequest, ".url"},
+		{"create", "POST", "/v1/admin/webhooks", "s3cret", `{"url": "https://partner.example.com", "event_types": ["user.created"]}`, http.StatusCreated, `"secret":"`},
+		{"get", "GET", "/v1/admin/webhooks/" + hookID, "s3cret", ``, http.StatusOK, `"url":"https://partner.example.com"`},
+		{"get missing", "GET", "/v1/admin/webhooks/0f9e8d7c-6b5a-4c3d-8e2f-1a0b9c8d7e6f", "s3cret", ``, http.StatusNotFound, ""},
+		{"modify", "PUT", "/v1/admin/webhooks/" + hookID, "s3cret", `{"url": "https://partner.example.com/v2"}`, http.StatusNoContent, ""},
+		{"deliveries", "GET", "/v1/admin/webhooks/" + hookID + "/deliveries?state=dead", "s3cret", ``, http.StatusOK, `"state":"dead"`},
+		{"bad state", "GET", "/v1/admin/webhooks/" + hookID + "/deliveries?state=lost", "s3cret", ``, http.StatusBadRequest, ""},
+		{"retry", "POST", "/v1/admin/webhooks/" + hookID + "/deliveries/1/retry", "s3cret", ``, http.StatusNoContent, ""},
+		{"retry missing", "POST", "/v1/admin/webhooks/" + hookID + "/deliveries/2/retry", "s3cret", ``, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		rs := do(tt.method, tt.path, tt.token, tt.body)
+		if rs.Code != tt.wantStatus {
+			t.Errorf("%q: want status %d, have %d: %s", tt.comment, tt.wantStatus, rs.Code, rs.Body.String())
+		}
+		if !strings.Contains(rs.Body.String(), tt.wantBody) {
+			t.Errorf("%q: want body containing %q, have: %s", tt.comment, tt.wantBody, rs.Body.String())
+		}
+	}
+
+	// Secrets are never revealed after creation
+	for _, path := range []string{"/v1/admin/webhooks", "/v1/admin/webhooks/" + hookID} {
+		if rs := do("GET", path, "s3cret", ""); strings.Contains(rs.Body.String(), "secret") {
+			t.Errorf("%s: secret revealed: %s", path, rs.Body.String())
+		}
+	}
+	// Secret is kept if not provided when modifying
+	if modified == nil || modified.Secret != "" || modified.URL != "https://partner.example.com/v2" {
+		t.Errorf("bad modification: %+v", modified)
+	}
+}